@@ -0,0 +1,307 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The /api/v1 routes are for other tools. They take and return JSON, and are
+// described by api/openapi.json, which is kept next to the handlers and must
+// be updated with them.
+
+//go:embed api/openapi.json
+var openApiSpec []byte
+
+// apiErrorBody is the body of every API error.
+type apiErrorBody struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func apiError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiErrorBody{apiErrorDetail{Code: code, Message: message}})
+}
+
+func apiJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("[ERROR]: API response error: %v\n", err)
+	}
+}
+
+func apiRoutes(r chi.Router) {
+	r.Get("/openapi.json", apiSpec)
+	r.Group(func(r chi.Router) {
+		r.Use(apiAuth)
+		r.Get("/queries", apiQueries)
+		r.Get("/queries/{name}", apiQuery)
+		r.Post("/run", apiRun)
+		r.Post("/export", apiExport)
+		r.Get("/history", apiHistory)
+	})
+}
+
+type apiTokenKey struct{}
+
+// apiAuth checks the bearer token of the request.
+func apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, 401, "unauthorized", "an API token is required as a Bearer token")
+			return
+		}
+
+		token, err := apiTokens.verify(strings.TrimSpace(bearer))
+		if errors.Is(err, errBadToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			apiError(w, 401, "unauthorized", err.Error())
+			return
+		} else if err != nil {
+			fmt.Printf("[ERROR]: API token error: %v\n", err)
+			apiError(w, 500, "internal", "the API tokens could not be read")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, token)))
+	})
+}
+
+func requestToken(r *http.Request) apiToken {
+	t, _ := r.Context().Value(apiTokenKey{}).(apiToken)
+	return t
+}
+
+func apiSpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openApiSpec)
+}
+
+type apiSavedQuery struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Chart       *chartConfig `json:"chart,omitempty"`
+	Sql         string       `json:"sql,omitempty"`
+}
+
+func apiQueries(w http.ResponseWriter, r *http.Request) {
+	index, err := queries.list()
+	if err != nil {
+		apiError(w, 500, "internal", err.Error())
+		return
+	}
+
+	out := make([]apiSavedQuery, len(index))
+	for i, q := range index {
+		out[i] = apiSavedQuery{Name: q.Name, Description: q.Description, Chart: q.Chart}
+	}
+	apiJson(w, out)
+}
+
+func apiQuery(w http.ResponseWriter, r *http.Request) {
+	q, sql, err := queries.load(chi.URLParam(r, "name"))
+	if err != nil {
+		apiError(w, 404, "not_found", err.Error())
+		return
+	}
+	apiJson(w, apiSavedQuery{Name: q.Name, Description: q.Description, Chart: q.Chart, Sql: sql})
+}
+
+// apiRunRequest is the body of /run and /export. One of Sql and Query, the
+// name of a saved query, is given. Full runs ad-hoc SQL unsampled on tenants
+// whose policy samples it by default.
+type apiRunRequest struct {
+	Sql    string `json:"sql"`
+	Query  string `json:"query"`
+	Tenant string `json:"tenant"`
+	Sample bool   `json:"sample"`
+	Full   bool   `json:"full"`
+	Format string `json:"format"`
+}
+
+func decodeApiRun(w http.ResponseWriter, r *http.Request) (apiRunRequest, bool) {
+	defer r.Body.Close()
+
+	var body apiRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apiError(w, 400, "bad_request", "the body is not valid JSON: "+err.Error())
+		return body, false
+	}
+	return body, true
+}
+
+// apiExecute runs the query of an API request as the token's user, writing
+// an error response and returning nil when it fails.
+func apiExecute(w http.ResponseWriter, r *http.Request, body apiRunRequest) *resultSet {
+	sql := body.Sql
+	switch {
+	case (body.Sql == "") == (body.Query == ""):
+		apiError(w, 400, "bad_request", "give one of sql or query")
+		return nil
+	case body.Query != "":
+		_, saved, err := queries.load(body.Query)
+		if err != nil {
+			apiError(w, 404, "not_found", err.Error())
+			return nil
+		}
+		sql = saved
+	}
+
+	statements := splitStatements(sql)
+	if len(statements) != 1 {
+		apiError(w, 400, "bad_request", fmt.Sprintf("expected one statement, found %d", len(statements)))
+		return nil
+	}
+
+	token := requestToken(r)
+	if body.Tenant == "" {
+		body.Tenant = token.Tenants[0]
+	}
+	if !slices.Contains(token.Tenants, body.Tenant) {
+		apiError(w, 403, "forbidden", fmt.Sprintf("the token is not allowed on tenant %q", body.Tenant))
+		return nil
+	}
+
+	creds, err := token.credentials(body.Tenant)
+	if err != nil {
+		fmt.Printf("[ERROR]: API token credentials error: %v\n", err)
+		apiError(w, 500, "internal", "the token's credentials could not be read")
+		return nil
+	}
+
+	data := queryRequest{
+		Username: creds.Username,
+		Password: creds.Password,
+		Tenant:   body.Tenant,
+		Sample:   body.Sample,
+		Query:    statements[0],
+	}
+
+	if err := guardUnattended(&data, body.Full); errors.Is(err, errApprovalRequired) {
+		apiError(w, 403, "approval_required", err.Error())
+		return nil
+	} else if err != nil {
+		apiError(w, 500, "internal", err.Error())
+		return nil
+	}
+
+	run := startRun("")
+	rs, err := runResultSet(r.Context(), data, run)
+
+	entry := newHistoryEntry(historyRun, data, err)
+	entry.Rows = run.rowCount()
+	entry.DurationMs = time.Since(run.start).Milliseconds()
+	history.record(entry)
+	params := map[string]string{"sample": strconv.FormatBool(data.Sample)}
+	if body.Query != "" {
+		params["savedQuery"] = body.Query
+	}
+	auditExecution(r, entry, cmp.Or(body.Format, "json"), params)
+
+	var (
+		fault *eamFault
+		busy  *errBusy
+	)
+	switch {
+	case errors.As(err, &busy):
+		w.Header().Set("Retry-After", strconv.Itoa(busy.seconds()))
+		apiError(w, 429, "too_many_requests", err.Error())
+		return nil
+	case errors.As(err, &fault):
+		apiError(w, 422, "eam_fault", strings.TrimSpace(fault.Message))
+		return nil
+	case err != nil:
+		apiError(w, 502, "eam_unavailable", err.Error())
+		return nil
+	}
+
+	return rs
+}
+
+// apiRun runs a query and returns the result as JSON.
+func apiRun(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeApiRun(w, r)
+	if !ok {
+		return
+	}
+
+	if rs := apiExecute(w, r, body); rs != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if err := writeResultJson(w, rs); err != nil {
+			fmt.Printf("[ERROR]: API response error: %v\n", err)
+		}
+	}
+}
+
+// apiExport runs a query and downloads the result as csv, xlsx or json.
+func apiExport(w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeApiRun(w, r)
+	if !ok {
+		return
+	}
+
+	switch body.Format {
+	case "csv", "xlsx", "json":
+	default:
+		apiError(w, 400, "bad_request", fmt.Sprintf("unknown format %q, use csv, xlsx or json", body.Format))
+		return
+	}
+
+	rs := apiExecute(w, r, body)
+	if rs == nil {
+		return
+	}
+
+	if err := exportResult(w, body.Format, rs); err != nil {
+		fmt.Printf("[ERROR]: API export error: %v\n", err)
+	}
+}
+
+// apiHistory returns the newest runs on the token's tenants.
+func apiHistory(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			apiError(w, 400, "bad_request", "limit must be a positive number")
+			return
+		}
+		limit = min(n, 1000)
+	}
+
+	all, err := history.entries(0)
+	if err != nil {
+		apiError(w, 500, "internal", err.Error())
+		return
+	}
+
+	token := requestToken(r)
+	out := []historyEntry{}
+	for _, e := range all {
+		if len(out) == limit {
+			break
+		}
+		if slices.Contains(token.Tenants, e.Tenant) {
+			out = append(out, e)
+		}
+	}
+	apiJson(w, out)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// apiToken lets another tool use /api/v1 as an EAM user without knowing the
+// password. Only a hash of the token's secret is kept; the EAM passwords are
+// sealed with the server key. Logins has the EAM login for each tenant;
+// tokens made before that have a single Username and Password for all.
+type apiToken struct {
+	Id        string                `json:"id"`
+	Name      string                `json:"name"`
+	Hash      string                `json:"hash"`
+	Tenants   []string              `json:"tenants"`
+	Logins    map[string]tokenLogin `json:"logins,omitempty"`
+	Username  string                `json:"username,omitempty"`
+	Password  string                `json:"password,omitempty"`
+	CreatedAt time.Time             `json:"createdAt"`
+}
+
+// tokenLogin is an EAM login with its password sealed.
+type tokenLogin struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+const apiTokenPrefix = "gs_"
+
+type apiTokenStore struct {
+	mu sync.Mutex
+}
+
+var apiTokens = &apiTokenStore{}
+
+func apiTokensPath() string {
+	return filepath.Join(config.DataDir, "api_tokens.json")
+}
+
+func (s *apiTokenStore) read() ([]apiToken, error) {
+	data, err := os.ReadFile(apiTokensPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var tokens []apiToken
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", apiTokensPath(), err)
+	}
+	return tokens, nil
+}
+
+func (s *apiTokenStore) write(tokens []apiToken) error {
+	data, err := json.MarshalIndent(tokens, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(config.DataDir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(apiTokensPath(), append(data, '\n'))
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// create issues a token for the tenants in logins, running as each one's
+// credentials, and returns it. The token itself is only ever shown this
+// once.
+func (s *apiTokenStore) create(name string, tenants []string, logins map[string]credentials) (string, apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.read()
+	if err != nil {
+		return "", apiToken{}, err
+	}
+
+	id, secret := make([]byte, 4), make([]byte, 24)
+	rand.Read(id)
+	rand.Read(secret)
+
+	t := apiToken{
+		Id:        hex.EncodeToString(id),
+		Name:      name,
+		Hash:      hashTokenSecret(hex.EncodeToString(secret)),
+		Tenants:   tenants,
+		Logins:    map[string]tokenLogin{},
+		CreatedAt: time.Now().UTC(),
+	}
+	for _, tenant := range tenants {
+		creds := logins[tenant]
+		sealed, err := sealSecret(creds.Password)
+		if err != nil {
+			return "", apiToken{}, err
+		}
+		t.Logins[tenant] = tokenLogin{Username: creds.Username, Password: sealed}
+	}
+
+	if err = s.write(append(tokens, t)); err != nil {
+		return "", apiToken{}, err
+	}
+	return apiTokenPrefix + t.Id + "_" + hex.EncodeToString(secret), t, nil
+}
+
+// revoke removes the token with the given id.
+func (s *apiTokenStore) revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(tokens, func(t apiToken) bool { return t.Id == id })
+	if i < 0 {
+		return fmt.Errorf("no token %q", id)
+	}
+	return s.write(slices.Delete(tokens, i, i+1))
+}
+
+func (s *apiTokenStore) list() ([]apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read()
+}
+
+var errBadToken = errors.New("invalid API token")
+
+// verify returns the token that token is the secret of.
+func (s *apiTokenStore) verify(token string) (apiToken, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, apiTokenPrefix), "_")
+	if !ok || !strings.HasPrefix(token, apiTokenPrefix) {
+		return apiToken{}, errBadToken
+	}
+
+	tokens, err := s.list()
+	if err != nil {
+		return apiToken{}, err
+	}
+
+	i := slices.IndexFunc(tokens, func(t apiToken) bool { return t.Id == id })
+	if i < 0 || subtle.ConstantTimeCompare([]byte(tokens[i].Hash), []byte(hashTokenSecret(secret))) != 1 {
+		return apiToken{}, errBadToken
+	}
+	return tokens[i], nil
+}
+
+// credentials returns the EAM credentials the token runs queries as on
+// tenant.
+func (t apiToken) credentials(tenant string) (credentials, error) {
+	login, ok := t.Logins[tenant]
+	if !ok {
+		if t.Username == "" {
+			return credentials{}, fmt.Errorf("the token has no login for %s", tenant)
+		}
+		login = tokenLogin{Username: t.Username, Password: t.Password}
+	}
+
+	password, err := openSecret(login.Password)
+	if err != nil {
+		return credentials{}, err
+	}
+	return credentials{Username: login.Username, Password: password}, nil
+}
+
+// usernames lists the EAM users of the token, by tenant.
+func (t apiToken) usernames() string {
+	if len(t.Logins) == 0 {
+		return t.Username
+	}
+	var names []string
+	for _, tenant := range t.Tenants {
+		names = append(names, tenant+":"+t.Logins[tenant].Username)
+	}
+	return strings.Join(names, ",")
+}
+
+const tokensUsage = `Usage of tokens:
+  go-server tokens create -name NAME -tenant TENANT[,TENANT...]
+  go-server tokens list
+  go-server tokens revoke ID
+
+create takes the EAM credentials the same way as run, from EAM_USERNAME and
+EAM_PASSWORD or a credentials file, and prints the token once. With a
+credentials file each tenant uses its own entry.
+`
+
+// cliTokens manages the API tokens and returns the exit code.
+func cliTokens(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, tokensUsage)
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("tokens "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, tokensUsage) }
+	name := fs.String("name", "", "")
+	tenantList := fs.String("tenant", "", "")
+	credentialsFile := fs.String("credentials", os.Getenv("EAM_CREDENTIALS"), "")
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOk
+		}
+		return exitUsage
+	}
+
+	fail := func(format string, a ...any) int {
+		fmt.Fprintf(stderr, "go-server tokens %s: "+format+"\n", append([]any{args[0]}, a...)...)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "create":
+		var tenants []string
+		for _, t := range strings.Split(*tenantList, ",") {
+			if t = strings.TrimSpace(t); t == "" {
+				continue
+			}
+			if _, ok := config.tenant(t); !ok {
+				return fail("unknown tenant %q", t)
+			}
+			tenants = append(tenants, t)
+		}
+		if *name == "" || len(tenants) == 0 {
+			return fail("a token needs a -name and at least one -tenant")
+		}
+
+		logins := map[string]credentials{}
+		for _, tenant := range tenants {
+			creds, err := loadCredentials(*credentialsFile, tenant)
+			if err != nil {
+				return fail("%v", err)
+			}
+			logins[tenant] = creds
+		}
+
+		token, t, err := apiTokens.create(*name, tenants, logins)
+		if err != nil {
+			return fail("%v", err)
+		}
+		fmt.Fprintf(stderr, "created token %s for %s, it is not shown again\n", t.Id, t.usernames())
+		fmt.Fprintln(stdout, token)
+
+	case "list":
+		tokens, err := apiTokens.list()
+		if err != nil {
+			return fail("%v", err)
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		for _, t := range tokens {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.Id, t.Name, t.usernames(), strings.Join(t.Tenants, ","), t.CreatedAt.Format(time.DateOnly))
+		}
+		tw.Flush()
+
+	case "revoke":
+		if fs.NArg() != 1 {
+			fmt.Fprint(stderr, tokensUsage)
+			return exitUsage
+		}
+		if err := apiTokens.revoke(fs.Arg(0)); err != nil {
+			return fail("%v", err)
+		}
+
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], tokensUsage)
+		return exitUsage
+	}
+
+	return exitOk
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// An approval lets ad-hoc SQL run on a tenant whose policy requires a second
+// user to look at it first. Approved SQL stays approved, so re-runs go
+// straight through; any change to it, other than whitespace, needs a new
+// approval.
+type approval struct {
+	Id          string    `json:"id"`
+	Tenant      string    `json:"tenant"`
+	Sql         string    `json:"sql"`
+	Hash        string    `json:"hash"`
+	Status      string    `json:"status"`
+	RequestedBy string    `json:"requestedBy"`
+	RequestedAt time.Time `json:"requestedAt"`
+	DecidedBy   string    `json:"decidedBy,omitempty"`
+	DecidedAt   time.Time `json:"decidedAt"`
+}
+
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+)
+
+type approvalStore struct {
+	mu sync.Mutex
+}
+
+var approvals = &approvalStore{}
+
+func approvalsPath() string {
+	return filepath.Join(config.DataDir, "approvals.json")
+}
+
+// sqlHash identifies SQL regardless of its whitespace.
+func sqlHash(sql string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(sql), " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *approvalStore) read() ([]approval, error) {
+	data, err := os.ReadFile(approvalsPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list []approval
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", approvalsPath(), err)
+	}
+	return list, nil
+}
+
+func (s *approvalStore) write(list []approval) error {
+	data, err := json.MarshalIndent(list, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(config.DataDir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(approvalsPath(), append(data, '\n'))
+}
+
+func (s *approvalStore) list() ([]approval, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read()
+}
+
+// find returns the approval of sql on tenant, preferring an approved one
+// over the latest request.
+func (s *approvalStore) find(tenant, sql string) (approval, bool, error) {
+	list, err := s.list()
+	if err != nil {
+		return approval{}, false, err
+	}
+
+	hash := sqlHash(sql)
+	var found approval
+	ok := false
+	for _, a := range list {
+		if a.Tenant != tenant || a.Hash != hash {
+			continue
+		}
+		if a.Status == approvalApproved {
+			return a, true, nil
+		}
+		found, ok = a, true
+	}
+	return found, ok, nil
+}
+
+// approved reports whether sql may run on tenant under its policy.
+func (s *approvalStore) approved(tenant, sql string) (bool, error) {
+	if !policyFor(tenant).RequireApproval {
+		return true, nil
+	}
+	a, ok, err := s.find(tenant, sql)
+	return ok && a.Status == approvalApproved, err
+}
+
+// request asks for sql to be approved on tenant, or returns the request
+// already waiting for it.
+func (s *approvalStore) request(tenant, sql, user string) (approval, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, err := s.read()
+	if err != nil {
+		return approval{}, err
+	}
+
+	hash := sqlHash(sql)
+	i := slices.IndexFunc(list, func(a approval) bool {
+		return a.Tenant == tenant && a.Hash == hash && a.Status != approvalRejected
+	})
+	if i >= 0 {
+		return list[i], nil
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	a := approval{
+		Id:          hex.EncodeToString(b),
+		Tenant:      tenant,
+		Sql:         sql,
+		Hash:        hash,
+		Status:      approvalPending,
+		RequestedBy: user,
+		RequestedAt: time.Now(),
+	}
+	return a, s.write(append(list, a))
+}
+
+// decide approves or rejects a pending request. Nobody decides on their own.
+func (s *approvalStore) decide(id, user string, approve bool) (approval, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, err := s.read()
+	if err != nil {
+		return approval{}, err
+	}
+
+	i := slices.IndexFunc(list, func(a approval) bool { return a.Id == id })
+	switch {
+	case i < 0:
+		return approval{}, fmt.Errorf("no approval request %q", id)
+	case list[i].Status != approvalPending:
+		return approval{}, fmt.Errorf("the request was already %s", list[i].Status)
+	case strings.EqualFold(list[i].RequestedBy, user):
+		return approval{}, errors.New("another user has to decide on your own request")
+	}
+
+	list[i].Status = approvalRejected
+	if approve {
+		list[i].Status = approvalApproved
+	}
+	list[i].DecidedBy, list[i].DecidedAt = user, time.Now()
+	return list[i], s.write(list)
+}
+
+// requestApproval asks for the query of the guard panel to be approved.
+func requestApproval(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	tenant, sql := r.Form.Get("tenant"), r.Form.Get("query")
+	if !policyFor(tenant).RequireApproval || strings.TrimSpace(sql) == "" {
+		errorResponse(w, "this query needs no approval", 400)
+		return
+	}
+
+	a, err := approvals.request(tenant, sql, requestUser(r).Name)
+	auditApproval(r, auditApprovalRequest, a, err)
+	if err != nil {
+		errorResponse(w, err.Error(), 500)
+		return
+	}
+
+	renderApprovalStatus(w, a)
+}
+
+func renderApprovalStatus(w http.ResponseWriter, a approval) {
+	tmpl, err := template.ParseFiles("views/guard_panel.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tmpl.ExecuteTemplate(w, "approval_status", a); err != nil {
+		fmt.Printf("[ERROR]: Approval template execution error: %v\n", err)
+	}
+}
+
+type approvalsPage struct {
+	User    appUser
+	Pending []approval
+	Decided []approval
+	Error   string
+	Notice  string
+}
+
+// approvalsPageDecided is how many decided requests the page shows.
+const approvalsPageDecided = 100
+
+// approvalList shows the requests waiting for a decision and the latest
+// decisions.
+func approvalList(w http.ResponseWriter, r *http.Request) {
+	renderApprovals(w, r, approvalsPage{})
+}
+
+func renderApprovals(w http.ResponseWriter, r *http.Request, page approvalsPage) {
+	page.User = requestUser(r)
+
+	list, err := approvals.list()
+	if err != nil {
+		page.Error = err.Error()
+	}
+	slices.Reverse(list)
+	for _, a := range list {
+		if a.Status == approvalPending {
+			page.Pending = append(page.Pending, a)
+		} else if len(page.Decided) < approvalsPageDecided {
+			page.Decided = append(page.Decided, a)
+		}
+	}
+
+	tmpl, err := template.New("query_index.html").Funcs(template.FuncMap{
+		"datetime": func(t time.Time) string { return t.Local().Format(time.DateTime) },
+		"same":     strings.EqualFold,
+	}).ParseFiles("views/query_index.html", "views/approvals.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tmpl.Execute(w, page); err != nil {
+		fmt.Printf("[ERROR]: Approvals template execution error: %v\n", err)
+	}
+}
+
+// decideApproval approves or rejects a request from the approvals page.
+func decideApproval(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		event := auditApprovalReject
+		if approve {
+			event = auditApprovalApprove
+		}
+
+		a, err := approvals.decide(chi.URLParam(r, "id"), requestUser(r).Name, approve)
+		auditApproval(r, event, a, err)
+
+		page := approvalsPage{}
+		if err != nil {
+			page.Error = err.Error()
+		} else {
+			page.Notice = fmt.Sprintf("%s the query of %s on %s", strings.ToUpper(a.Status[:1])+a.Status[1:], a.RequestedBy, a.Tenant)
+		}
+		renderApprovals(w, r, page)
+	}
+}
+
+// auditApproval records a request for or a decision on an approval.
+func auditApproval(r *http.Request, event string, a approval, err error) {
+	e := auditEntry{
+		Event:   event,
+		Tenant:  a.Tenant,
+		Sql:     a.Sql,
+		Params:  map[string]string{"approval": a.Id, "requestedBy": a.RequestedBy},
+		Outcome: runStatus(err),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	auditActor(&e, r)
+	audit.record(e)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log records who ran what on production tenants, and every
+// change to the saved queries. It is JSONL where each entry carries the hash
+// of the one before, so editing or removing an entry breaks the chain from
+// there on. go-server audit verify checks it and prints the last hash, which
+// can be kept elsewhere to also detect the end being cut off.
+
+// auditConfig sets which executions are audited. Production tenants always
+// are; AllTenants adds the others.
+type auditConfig struct {
+	AllTenants bool `json:"allTenants"`
+}
+
+type auditEntry struct {
+	Seq     int64             `json:"seq"`
+	Time    time.Time         `json:"time"`
+	Event   string            `json:"event"`
+	User    string            `json:"user"`
+	Source  string            `json:"source"`
+	Ip      string            `json:"ip,omitempty"`
+	EamUser string            `json:"eamUser,omitempty"`
+	Tenant  string            `json:"tenant,omitempty"`
+	Sql     string            `json:"sql,omitempty"`
+	Params  map[string]string `json:"params,omitempty"`
+	Rows    int               `json:"rows"`
+	Format  string            `json:"format,omitempty"`
+	Outcome string            `json:"outcome"`
+	Error   string            `json:"error,omitempty"`
+	Prev    string            `json:"prev"`
+	Hash    string            `json:"hash,omitempty"`
+}
+
+// Audit events.
+const (
+	auditExecute     = "execute"
+	auditExport      = "export"
+	auditQuerySave   = "query-save"
+	auditQueryChart  = "query-chart"
+	auditQueryRemove = "query-remove"
+	auditQueryRename = "query-rename"
+	auditQueryImport = "query-import"
+	auditQueryRepair = "query-repair"
+
+	auditApprovalRequest = "approval-request"
+	auditApprovalApprove = "approval-approve"
+	auditApprovalReject  = "approval-reject"
+)
+
+type auditLog struct {
+	mu sync.Mutex
+}
+
+var audit = &auditLog{}
+
+const auditLockWait = 10 * time.Second
+
+func auditPath() string {
+	return filepath.Join(config.DataDir, "audit.jsonl")
+}
+
+// auditHash chains an entry, encoded without its hash, to the previous one.
+func auditHash(prev string, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, prev+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// append numbers e, chains it to the last entry and writes it. The lock file
+// keeps the server and the command line from forking the chain.
+func (a *auditLog) append(e auditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	path := auditPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	unlock, err := lockFile(path+".lock", auditLockWait)
+	if err != nil {
+		return fmt.Errorf("locking %s: %w", path, err)
+	}
+	defer unlock()
+
+	var last auditEntry
+	line, err := lastLine(path)
+	if err != nil {
+		return err
+	}
+	if line != nil {
+		if err = json.Unmarshal(line, &last); err != nil {
+			return fmt.Errorf("reading the last entry of %s: %w", path, err)
+		}
+	}
+
+	e.Seq, e.Prev, e.Hash = last.Seq+1, last.Hash, ""
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	e.Hash = auditHash(e.Prev, body)
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return appendLine(path, data)
+}
+
+// record appends e, logging rather than returning a failure so that callers
+// in the middle of a response don't have to handle it.
+func (a *auditLog) record(e auditEntry) {
+	if err := a.append(e); err != nil {
+		fmt.Printf("[ERROR]: Audit write error: %v\n", err)
+	}
+}
+
+// lastLine returns the last line of the file at path, or nil when it is
+// empty or doesn't exist. It reads backwards, so the size of the file
+// doesn't matter.
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var tail []byte
+	chunk := make([]byte, 64*1024)
+	for end := info.Size(); end > 0; {
+		start := max(end-int64(len(chunk)), 0)
+		n, err := f.ReadAt(chunk[:end-start], start)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		tail = append(slices.Clone(chunk[:n]), tail...)
+		end = start
+
+		trimmed := strings.TrimRight(string(tail), "\n")
+		if i := strings.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return []byte(trimmed[i+1:]), nil
+		}
+		if end == 0 && trimmed != "" {
+			return []byte(trimmed), nil
+		}
+	}
+	return nil, nil
+}
+
+// scan calls fn with each entry and its raw line, in order.
+func (a *auditLog) scan(fn func(e auditEntry, line []byte) error) error {
+	f, err := os.Open(auditPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if err := fn(e, sc.Bytes()); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// verify checks the chain and returns the number of entries and the hash of
+// the last one.
+func (a *auditLog) verify() (int64, string, error) {
+	var count int64
+	prev := ""
+	err := a.scan(func(e auditEntry, _ []byte) error {
+		count++
+		if e.Seq != count {
+			return fmt.Errorf("entry %d: expected sequence number %d, an entry is missing or was inserted", e.Seq, count)
+		}
+		if e.Prev != prev {
+			return fmt.Errorf("entry %d: does not follow entry %d", e.Seq, count-1)
+		}
+
+		hash := e.Hash
+		e.Hash = ""
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if auditHash(e.Prev, body) != hash {
+			return fmt.Errorf("entry %d: hash mismatch, the entry was changed", e.Seq)
+		}
+		prev = hash
+		return nil
+	})
+	return count, prev, err
+}
+
+// audited reports whether executions on tenant are audited.
+func audited(tenant string) bool {
+	t, ok := config.tenant(tenant)
+	return config.Audit.AllTenants || (ok && t.Production)
+}
+
+// auditActor fills in who made a request and from where. r is nil for the
+// command line.
+func auditActor(e *auditEntry, r *http.Request) {
+	if r == nil {
+		e.Source = "cli"
+		if u, err := user.Current(); err == nil {
+			e.User = u.Username
+		}
+		return
+	}
+
+	e.Ip = clientIp(r)
+	if t := requestToken(r); t.Id != "" {
+		e.Source, e.User = "api", "token:"+t.Name
+		return
+	}
+	e.Source, e.User = "web", requestUser(r).Name
+}
+
+// clientIp is the address of the client, or the one a trusted proxy
+// forwarded for. Clients can send X-Forwarded-For themselves, so it is read
+// from the right: the first address that isn't a trusted proxy is the one
+// the proxies saw.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !fromTrustedProxy(r) {
+		return host
+	}
+
+	var hops []string
+	for _, fwd := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(fwd, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !trustedProxy(hops[i]) || i == 0 {
+			return hops[i]
+		}
+	}
+	return host
+}
+
+// auditExecution records a query run described by its history entry, when
+// its tenant is audited.
+func auditExecution(r *http.Request, h historyEntry, format string, params map[string]string) {
+	if !audited(h.Tenant) {
+		return
+	}
+
+	e := auditEntry{
+		Event:   auditExecute,
+		EamUser: h.Username,
+		Tenant:  h.Tenant,
+		Sql:     h.Query,
+		Params:  params,
+		Rows:    h.Rows,
+		Format:  format,
+		Outcome: h.Status,
+		Error:   h.Error,
+	}
+	auditActor(&e, r)
+	audit.record(e)
+}
+
+// auditCachedExport records a download of the cached result c, when its
+// tenant is audited.
+func auditCachedExport(r *http.Request, c cachedResult, rows int, format string, err error) {
+	if !audited(c.Tenant) {
+		return
+	}
+
+	e := auditEntry{Event: auditExport, EamUser: c.Username, Tenant: c.Tenant, Sql: c.Query, Rows: rows, Format: format, Outcome: runStatus(err)}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	auditActor(&e, r)
+	audit.record(e)
+}
+
+// auditQueryChange records a change to the saved queries.
+func auditQueryChange(r *http.Request, event, name, sql string, params map[string]string, err error) {
+	if params == nil {
+		params = map[string]string{}
+	}
+	params["name"] = name
+
+	e := auditEntry{Event: event, Sql: sql, Params: params, Outcome: runStatus(err)}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	auditActor(&e, r)
+	audit.record(e)
+}
+
+// auditFilter selects entries on the audit page. Text matches the SQL and
+// the parameters.
+type auditFilter struct {
+	User   string
+	Tenant string
+	Event  string
+	Text   string
+	From   string
+	To     string
+}
+
+func (f auditFilter) matches(e auditEntry) bool {
+	contains := func(s, sub string) bool { return strings.Contains(strings.ToLower(s), strings.ToLower(sub)) }
+	if f.User != "" && !contains(e.User, f.User) && !contains(e.EamUser, f.User) {
+		return false
+	}
+	if f.Tenant != "" && e.Tenant != f.Tenant {
+		return false
+	}
+	if f.Event != "" && e.Event != f.Event {
+		return false
+	}
+	if f.Text != "" {
+		found := contains(e.Sql, f.Text)
+		for _, v := range e.Params {
+			found = found || contains(v, f.Text)
+		}
+		if !found {
+			return false
+		}
+	}
+	day := e.Time.Local().Format(time.DateOnly)
+	if f.From != "" && day < f.From {
+		return false
+	}
+	if f.To != "" && day > f.To {
+		return false
+	}
+	return true
+}
+
+// auditPageLimit is how many matching entries the audit page shows.
+const auditPageLimit = 500
+
+type auditPage struct {
+	Filter  auditFilter
+	Tenants []tenantConfig
+	Events  []string
+	Entries []auditEntry
+	More    bool
+	Error   string
+}
+
+// auditSearch shows the newest audit entries matching the filter.
+func auditSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page := auditPage{
+		Filter: auditFilter{
+			User:   strings.TrimSpace(q.Get("user")),
+			Tenant: q.Get("tenant"),
+			Event:  q.Get("event"),
+			Text:   strings.TrimSpace(q.Get("text")),
+			From:   q.Get("from"),
+			To:     q.Get("to"),
+		},
+		Tenants: config.Tenants,
+		Events:  []string{auditExecute, auditExport, auditQuerySave, auditQueryChart, auditQueryRemove, auditQueryRename, auditQueryImport, auditQueryRepair, auditApprovalRequest, auditApprovalApprove, auditApprovalReject},
+	}
+
+	err := audit.scan(func(e auditEntry, _ []byte) error {
+		if page.Filter.matches(e) {
+			page.Entries = append(page.Entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		page.Error = err.Error()
+	}
+
+	slices.Reverse(page.Entries)
+	if len(page.Entries) > auditPageLimit {
+		page.Entries, page.More = page.Entries[:auditPageLimit], true
+	}
+
+	tmpl, err := template.New("query_index.html").Funcs(template.FuncMap{
+		"datetime": func(t time.Time) string { return t.Local().Format(time.DateTime) },
+	}).ParseFiles("views/query_index.html", "views/audit.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tmpl.Execute(w, page); err != nil {
+		fmt.Printf("[ERROR]: Audit template execution error: %v\n", err)
+	}
+}
+
+const auditUsage = `Usage of audit:
+  go-server audit verify
+
+verify checks the hash chain of data/audit.jsonl and prints the number of
+entries and the hash of the last one. Keep that hash somewhere else to be
+able to tell later that no entries were cut off the end.
+`
+
+// cliAudit checks the audit log and returns the exit code.
+func cliAudit(args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 || args[0] != "verify" {
+		fmt.Fprint(stderr, auditUsage)
+		return exitUsage
+	}
+
+	count, last, err := audit.verify()
+	if err != nil {
+		fmt.Fprintf(stderr, "go-server audit verify: %v\n", err)
+		return exitUsage
+	}
+	fmt.Fprintf(stdout, "%d entries, chain intact\nlast hash %s\n", count, last)
+	return exitOk
+}
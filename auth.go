@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authConfig sets how users of go-server are identified. Mode "local" signs
+// them in with a password from data/users.json, "header" trusts the user
+// name a reverse proxy puts in Header, and "none" lets everyone in as admin.
+// In header mode the header is only read from TrustedProxies, and users not
+// in users.json get DefaultRole.
+type authConfig struct {
+	Mode           string   `json:"mode"`
+	Header         string   `json:"header"`
+	TrustedProxies []string `json:"trustedProxies"`
+	DefaultRole    string   `json:"defaultRole"`
+	IdleMinutes    int      `json:"idleMinutes"`
+}
+
+const appSessionCookie = "gs-session"
+
+type appSession struct {
+	user string
+	used time.Time
+}
+
+// appSessionStore holds the signed in browsers. Only the user name is kept,
+// the role is looked up on every request so changes apply at once.
+type appSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*appSession
+}
+
+var appSessions = &appSessionStore{sessions: map[string]*appSession{}}
+
+func (s *appSessionStore) create(user string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[id] = &appSession{user: user, used: time.Now()}
+	return id
+}
+
+func (s *appSessionStore) get(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idle := time.Duration(max(config.Auth.IdleMinutes, 1)) * time.Minute
+	now := time.Now()
+	for sid, sess := range s.sessions {
+		if now.Sub(sess.used) > idle {
+			delete(s.sessions, sid)
+		}
+	}
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return "", false
+	}
+	sess.used = now
+	return sess.user, true
+}
+
+func (s *appSessionStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+}
+
+type appUserKey struct{}
+
+// requestUser returns the user a request was authenticated as.
+func requestUser(r *http.Request) appUser {
+	u, _ := r.Context().Value(appUserKey{}).(appUser)
+	return u
+}
+
+// identify returns the user of the request by the configured mode.
+func identify(r *http.Request) (appUser, bool) {
+	switch config.Auth.Mode {
+	case "none":
+		return appUser{Name: "anonymous", Role: roleAdmin.String()}, true
+
+	case "header":
+		if !fromTrustedProxy(r) {
+			return appUser{}, false
+		}
+		name := strings.TrimSpace(r.Header.Get(config.Auth.Header))
+		if name == "" {
+			return appUser{}, false
+		}
+		u, ok, err := users.get(name)
+		if err != nil {
+			fmt.Printf("[ERROR]: User lookup error: %v\n", err)
+			return appUser{}, false
+		}
+		if !ok {
+			u = appUser{Name: name, Role: config.Auth.DefaultRole}
+		}
+		return u, u.role() > 0
+
+	default: // local
+		c, err := r.Cookie(appSessionCookie)
+		if err != nil {
+			return appUser{}, false
+		}
+		name, ok := appSessions.get(c.Value)
+		if !ok {
+			return appUser{}, false
+		}
+		u, ok, err := users.get(name)
+		if err != nil {
+			fmt.Printf("[ERROR]: User lookup error: %v\n", err)
+			return appUser{}, false
+		}
+		return u, ok && u.role() > 0
+	}
+}
+
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return trustedProxy(host)
+}
+
+// trustedProxy reports whether host is in one of config.Auth.TrustedProxies.
+func trustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+
+	for _, cidr := range config.Auth.TrustedProxies {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate lets signed in users through. Others are sent to the sign in
+// page, or get a 401 for htmx and non-GET requests.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := identify(r)
+		if !ok {
+			switch {
+			case config.Auth.Mode == "header":
+				errorResponse(w, "not signed in through the proxy", http.StatusUnauthorized)
+			case r.Header.Get("HX-Request") != "":
+				w.Header().Set("HX-Redirect", "/signin")
+				errorResponse(w, "sign in first", http.StatusUnauthorized)
+			case r.Method == http.MethodGet:
+				http.Redirect(w, r, "/signin", http.StatusSeeOther)
+			default:
+				errorResponse(w, "sign in first", http.StatusUnauthorized)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), appUserKey{}, u)))
+	})
+}
+
+// requireRole lets through users with at least the given role.
+func requireRole(min role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requestUser(r).role() < min {
+				errorResponse(w, fmt.Sprintf("this needs the %s role", min), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// queryAccess checks the SQL and tenants of a request that runs a query
+// against the user's role.
+func queryAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		tenants := append(r.Form["tenant"], r.Form["compare-tenant"]...)
+		if err := checkQueryAccess(requestUser(r), r.Form.Get("query"), tenants); err != nil {
+			errorResponse(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkQueryAccess returns why u may not run sql on tenants, if they may
+// not: viewers only run saved queries, analysts run anything on tenants that
+// are not production.
+func checkQueryAccess(u appUser, sql string, tenants []string) error {
+	userRole := u.role()
+	if sql == "" || userRole >= roleProdAnalyst {
+		return nil
+	}
+
+	if userRole == roleAnalyst && !slices.ContainsFunc(tenants, func(t string) bool {
+		tc, ok := config.tenant(t)
+		return ok && tc.Production
+	}) {
+		return nil
+	}
+
+	saved, err := isSavedSql(sql)
+	switch {
+	case err != nil:
+		return err
+	case saved:
+		return nil
+	case userRole == roleAnalyst:
+		return errors.New("your role only runs saved queries on production tenants")
+	default:
+		return errors.New("your role only runs saved queries")
+	}
+}
+
+// isSavedSql reports whether sql is the text of a saved query, ignoring
+// differences in whitespace.
+func isSavedSql(sql string) (bool, error) {
+	index, err := queries.list()
+	if err != nil {
+		return false, err
+	}
+
+	want := strings.Join(strings.Fields(sql), " ")
+	for _, q := range index {
+		saved, err := queries.readSql(q.Filename)
+		if err != nil {
+			continue
+		}
+		if strings.Join(strings.Fields(saved), " ") == want {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type signinPage struct {
+	Username string
+	Error    string
+}
+
+func signinForm(w http.ResponseWriter, r *http.Request) {
+	if config.Auth.Mode != "local" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	renderSignin(w, signinPage{})
+}
+
+func signin(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	if config.Auth.Mode != "local" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("username"))
+	u, err := users.verify(name, r.Form.Get("password"))
+	if err != nil {
+		if !errors.Is(err, errBadLogin) {
+			fmt.Printf("[ERROR]: Sign in error: %v\n", err)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		renderSignin(w, signinPage{Username: name, Error: errBadLogin.Error()})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     appSessionCookie,
+		Value:    appSessions.create(u.Name),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// signout ends the go-server session along with the browser's EAM login and
+// cached result.
+func signout(w http.ResponseWriter, r *http.Request) {
+	endEamSession(w, r)
+	results.remove(resultKey(w, r))
+	if c, err := r.Cookie(appSessionCookie); err == nil {
+		appSessions.remove(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: appSessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+
+	if r.Header.Get("HX-Request") != "" {
+		w.Header().Set("HX-Redirect", "/signin")
+		return
+	}
+	http.Redirect(w, r, "/signin", http.StatusSeeOther)
+}
+
+func renderSignin(w http.ResponseWriter, page signinPage) {
+	tmpl, err := template.ParseFiles("views/query_index.html", "views/signin.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tmpl.Execute(w, page); err != nil {
+		fmt.Printf("[ERROR]: Sign in template execution error: %v\n", err)
+	}
+}
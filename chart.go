@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// chartConfig describes a chart of a result. Columns are named rather than
+// numbered so the configuration still applies when it is saved with a query
+// and the query is changed later.
+type chartConfig struct {
+	Type   string   `json:"type"`
+	Title  string   `json:"title,omitempty"`
+	Label  string   `json:"label"`
+	Values []string `json:"values"`
+}
+
+var chartTypes = []string{"bar", "line", "pie"}
+
+var chartPalette = []string{"#2880ca", "#e6a23c", "#67c23a", "#f56c6c", "#9a7fd1", "#38b2ac", "#d4a373", "#909399"}
+
+const (
+	chartWidth     = 800
+	chartHeight    = 400
+	chartMaxPoints = 60
+)
+
+func parseChartConfig(form url.Values) chartConfig {
+	return chartConfig{
+		Type:   form.Get("type"),
+		Title:  strings.TrimSpace(form.Get("title")),
+		Label:  form.Get("label"),
+		Values: form["values"],
+	}
+}
+
+func (c chartConfig) values() url.Values {
+	return url.Values{"type": {c.Type}, "title": {c.Title}, "label": {c.Label}, "values": c.Values}
+}
+
+// chartSeries is one charted column.
+type chartSeries struct {
+	Name   string
+	Values []float64
+}
+
+// chartData picks the label and value columns out of rs. Values that are not
+// numbers count as zero.
+func (c chartConfig) chartData(rs *resultSet) ([]string, []chartSeries, error) {
+	if !slices.Contains(chartTypes, c.Type) {
+		return nil, nil, fmt.Errorf("unknown chart type %q", c.Type)
+	}
+
+	labelCol := rs.column(c.Label)
+	if labelCol < 0 {
+		return nil, nil, fmt.Errorf("no column %q for the labels", c.Label)
+	}
+	if len(c.Values) == 0 {
+		return nil, nil, errors.New("pick at least one column to chart")
+	}
+	if c.Type == "pie" && len(c.Values) > 1 {
+		return nil, nil, errors.New("a pie chart shows a single column")
+	}
+
+	rows := rs.Rows
+	if len(rows) > chartMaxPoints {
+		rows = rows[:chartMaxPoints]
+	}
+
+	labels := make([]string, len(rows))
+	for i, row := range rows {
+		labels[i] = row[labelCol]
+	}
+
+	series := make([]chartSeries, len(c.Values))
+	for s, name := range c.Values {
+		col := rs.column(name)
+		if col < 0 {
+			return nil, nil, fmt.Errorf("no column %q to chart", name)
+		}
+
+		series[s] = chartSeries{Name: name, Values: make([]float64, len(rows))}
+		for i, row := range rows {
+			series[s].Values[i], _ = strconv.ParseFloat(row[col], 64)
+		}
+	}
+
+	return labels, series, nil
+}
+
+// renderChart draws the chart of rs as a standalone SVG document.
+func renderChart(rs *resultSet, c chartConfig) (string, error) {
+	labels, series, err := c.chartData(rs)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" font-family="sans-serif" font-size="11">`,
+		chartWidth, chartHeight, chartWidth, chartHeight)
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/>`)
+	if c.Title != "" {
+		fmt.Fprintf(&b, `<text x="%d" y="20" text-anchor="middle" font-size="14" font-weight="bold">%s</text>`, chartWidth/2, html.EscapeString(c.Title))
+	}
+
+	if c.Type == "pie" {
+		drawPie(&b, labels, series[0])
+	} else {
+		drawAxes(&b, c.Type, labels, series)
+	}
+
+	b.WriteString("</svg>")
+	return b.String(), nil
+}
+
+// niceStep rounds a rough tick interval to 1, 2 or 5 times a power of ten.
+func niceStep(rough float64) float64 {
+	if rough <= 0 {
+		return 1
+	}
+	pow := math.Pow(10, math.Floor(math.Log10(rough)))
+	switch f := rough / pow; {
+	case f <= 1:
+		return pow
+	case f <= 2:
+		return 2 * pow
+	case f <= 5:
+		return 5 * pow
+	}
+	return 10 * pow
+}
+
+func drawAxes(b *strings.Builder, kind string, labels []string, series []chartSeries) {
+	const left, right, top, bottom = 60, 20, 40, 90
+	plotW, plotH := float64(chartWidth-left-right), float64(chartHeight-top-bottom)
+
+	lo, hi := 0.0, 0.0
+	for _, s := range series {
+		for _, v := range s.Values {
+			lo, hi = min(lo, v), max(hi, v)
+		}
+	}
+	step := niceStep((hi - lo) / 5)
+	lo, hi = math.Floor(lo/step)*step, math.Ceil(hi/step)*step
+	if hi == lo {
+		hi = lo + step
+	}
+	y := func(v float64) float64 { return top + plotH - (v-lo)/(hi-lo)*plotH }
+
+	// grid lines and the value axis
+	for v := lo; v <= hi+step/2; v += step {
+		fmt.Fprintf(b, `<line x1="%d" x2="%d" y1="%.1f" y2="%.1f" stroke="#e5e5e5"/>`, left, chartWidth-right, y(v), y(v))
+		fmt.Fprintf(b, `<text x="%d" y="%.1f" text-anchor="end" dominant-baseline="middle" fill="#555">%s</text>`, left-6, y(v), formatAggregate(v))
+	}
+	fmt.Fprintf(b, `<line x1="%d" x2="%d" y1="%.1f" y2="%.1f" stroke="#555"/>`, left, chartWidth-right, y(max(lo, 0)), y(max(lo, 0)))
+
+	n := max(len(labels), 1)
+	band := plotW / float64(n)
+	for i, label := range labels {
+		x := left + band*(float64(i)+0.5)
+		fmt.Fprintf(b, `<text transform="translate(%.1f %d) rotate(-40)" text-anchor="end" fill="#555">%s</text>`,
+			x, top+int(plotH)+14, html.EscapeString(truncateLabel(label)))
+	}
+
+	for s, ser := range series {
+		color := chartPalette[s%len(chartPalette)]
+		switch kind {
+		case "bar":
+			width := band * 0.8 / float64(len(series))
+			for i, v := range ser.Values {
+				x := left + band*float64(i) + band*0.1 + width*float64(s)
+				y0, y1 := y(max(lo, 0)), y(v)
+				fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s: %s</title></rect>`,
+					x, min(y0, y1), width, math.Abs(y0-y1), color, html.EscapeString(labels[i]), formatAggregate(v))
+			}
+		case "line":
+			points := make([]string, len(ser.Values))
+			for i, v := range ser.Values {
+				points[i] = fmt.Sprintf("%.1f,%.1f", left+band*(float64(i)+0.5), y(v))
+			}
+			fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`, strings.Join(points, " "), color)
+			for i, p := range points {
+				x, yy, _ := strings.Cut(p, ",")
+				fmt.Fprintf(b, `<circle cx="%s" cy="%s" r="3" fill="%s"><title>%s: %s</title></circle>`,
+					x, yy, color, html.EscapeString(labels[i]), formatAggregate(ser.Values[i]))
+			}
+		}
+	}
+
+	drawLegend(b, chartWidth-right, 30, seriesNames(series), "end")
+}
+
+func drawPie(b *strings.Builder, labels []string, ser chartSeries) {
+	const cx, cy, r = 260.0, 220.0, 150.0
+
+	total := 0.0
+	for _, v := range ser.Values {
+		total += max(v, 0)
+	}
+	if total == 0 {
+		fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle">No positive values to chart</text>`, chartWidth/2, chartHeight/2)
+		return
+	}
+
+	angle := -math.Pi / 2
+	for i, v := range ser.Values {
+		if v <= 0 {
+			continue
+		}
+		sweep := v / total * 2 * math.Pi
+		color := chartPalette[i%len(chartPalette)]
+		title := fmt.Sprintf("%s: %s (%.1f%%)", labels[i], formatAggregate(v), v/total*100)
+
+		if sweep >= 2*math.Pi-1e-9 {
+			fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s"><title>%s</title></circle>`, cx, cy, r, color, html.EscapeString(title))
+			break
+		}
+
+		x0, y0 := cx+r*math.Cos(angle), cy+r*math.Sin(angle)
+		angle += sweep
+		x1, y1 := cx+r*math.Cos(angle), cy+r*math.Sin(angle)
+		large := 0
+		if sweep > math.Pi {
+			large = 1
+		}
+		fmt.Fprintf(b, `<path d="M%.1f,%.1f L%.1f,%.1f A%.1f,%.1f 0 %d 1 %.1f,%.1f Z" fill="%s" stroke="#fff"><title>%s</title></path>`,
+			cx, cy, x0, y0, r, r, large, x1, y1, color, html.EscapeString(title))
+	}
+
+	drawLegend(b, 460, 80, labels, "start")
+}
+
+func drawLegend(b *strings.Builder, x, y int, names []string, anchor string) {
+	for i, name := range names {
+		if i >= 20 {
+			break
+		}
+		color := chartPalette[i%len(chartPalette)]
+		ty := y + i*16
+		if anchor == "end" {
+			fmt.Fprintf(b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`, x-10, ty-9, color)
+			fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, x-14, ty, html.EscapeString(truncateLabel(name)))
+		} else {
+			fmt.Fprintf(b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`, x, ty-9, color)
+			fmt.Fprintf(b, `<text x="%d" y="%d">%s</text>`, x+14, ty, html.EscapeString(truncateLabel(name)))
+		}
+	}
+}
+
+func seriesNames(series []chartSeries) []string {
+	names := make([]string, len(series))
+	for i, s := range series {
+		names[i] = s.Name
+	}
+	return names
+}
+
+func truncateLabel(s string) string {
+	if r := []rune(s); len(r) > 24 {
+		return string(r[:23]) + "…"
+	}
+	return s
+}
+
+type chartColumn struct {
+	Label   string
+	Numeric bool
+	IsLabel bool
+	IsValue bool
+}
+
+type chartPage struct {
+	Config    chartConfig
+	Types     []string
+	Columns   []chartColumn
+	QueryName string
+	Query     template.URL
+	Svg       template.HTML
+	Error     string
+	Saved     bool
+	CanSave   bool
+}
+
+// cachedView returns the client's cached result with its view applied.
+func cachedView(w http.ResponseWriter, r *http.Request) (*resultSet, bool) {
+	c, ok := requestResult(w, r)
+	if !ok {
+		return nil, false
+	}
+	return c.View.apply(c.Result), true
+}
+
+// resultChart shows the chart form for the cached result, and the chart when
+// one is configured. Without a configuration in the request, the one saved
+// with query-name is used.
+func resultChart(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	rs, ok := cachedView(w, r)
+	if !ok {
+		return
+	}
+
+	// saving changes the shared saved queries, which viewers may not
+	canSave := requestUser(r).role() >= roleAnalyst
+	page := chartPage{Types: chartTypes, QueryName: r.Form.Get("query-name"), CanSave: canSave}
+	page.Config = parseChartConfig(r.Form)
+	if page.Config.Type == "" {
+		page.Config.Type = "bar"
+		if q, _, err := queries.load(page.QueryName); err == nil && q.Chart != nil {
+			page.Config = *q.Chart
+		}
+	}
+
+	if r.Method == http.MethodPost && r.Form.Get("save") != "" && !canSave {
+		page.Error = fmt.Sprintf("Saving the chart needs the %s role", roleAnalyst)
+	} else if r.Method == http.MethodPost && r.Form.Get("save") != "" {
+		err := queries.setChart(page.QueryName, &page.Config)
+		auditQueryChange(r, auditQueryChart, page.QueryName, "", map[string]string{"chart": page.Config.Type}, err)
+		if err != nil {
+			page.Error = "Saving the chart failed: " + err.Error()
+		} else {
+			page.Saved = true
+		}
+	}
+
+	for i, label := range rs.Columns {
+		page.Columns = append(page.Columns, chartColumn{
+			Label:   label,
+			Numeric: rs.meta(i).Numeric(),
+			IsLabel: label == page.Config.Label,
+			IsValue: slices.Contains(page.Config.Values, label),
+		})
+	}
+
+	if page.Config.Label != "" {
+		svg, err := renderChart(rs, page.Config)
+		if err != nil {
+			page.Error = err.Error()
+		}
+		page.Svg = template.HTML(svg)
+		page.Query = template.URL(page.Config.values().Encode())
+	}
+
+	tmpl, err := template.ParseFiles("views/result_chart.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tmpl.Execute(w, page); err != nil {
+		fmt.Printf("[ERROR]: Chart template execution error: %v\n", err)
+	}
+}
+
+// resultChartSvg downloads the chart of the cached result as an SVG file.
+func resultChartSvg(w http.ResponseWriter, r *http.Request) {
+	c, ok := requestResult(w, r)
+	if !ok {
+		return
+	}
+	rs := c.View.apply(c.Result)
+
+	svg, err := renderChart(rs, parseChartConfig(r.URL.Query()))
+	auditCachedExport(r, c, len(rs.Rows), "chart-svg", err)
+	if err != nil {
+		errorResponse(w, err.Error(), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Content-Disposition", "attachment; filename=chart.svg")
+	w.Write([]byte(svg))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of the command line mode.
+const (
+	exitOk        = 0
+	exitUsage     = 1
+	exitTransport = 2
+	exitFault     = 3
+)
+
+const cliUsage = `Usage:
+  go-server                 start the web server on :42069
+  go-server run [flags]     run a query and write its result
+  go-server queries ...     manage the saved queries, see go-server queries help
+  go-server tokens ...      manage the API tokens, see go-server tokens help
+  go-server vault ...       manage the credential vault, see go-server vault help
+  go-server users ...       manage who can sign in, see go-server users help
+  go-server audit verify    check the hash chain of the audit log
+
+Credentials come from the vault entry given by -cred or EAM_CRED, from
+EAM_USERNAME and EAM_PASSWORD, or from the entry for the tenant in the file
+given by -credentials or EAM_CREDENTIALS:
+
+  { "WASHGAS_PRD": { "username": "...", "password": "..." } }
+
+A vault entry also sets the tenant, unless -tenant is given.
+
+Exit codes: 0 success, 1 usage or output error, 2 transport or parse error,
+3 SOAP fault returned by EAM.
+
+Flags of run:
+`
+
+// credentials are what a query is run as.
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loadCredentials returns the credentials for tenant, from the environment
+// when set and otherwise from the credentials file.
+func loadCredentials(path, tenant string) (credentials, error) {
+	if c := (credentials{Username: os.Getenv("EAM_USERNAME"), Password: os.Getenv("EAM_PASSWORD")}); c.Username != "" && c.Password != "" {
+		return c, nil
+	}
+
+	if path == "" {
+		return credentials{}, errors.New("no credentials, set EAM_USERNAME and EAM_PASSWORD or give a credentials file")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return credentials{}, err
+	}
+
+	var store map[string]credentials
+	if err = json.Unmarshal(data, &store); err != nil {
+		return credentials{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	c, ok := store[tenant]
+	if !ok || c.Username == "" || c.Password == "" {
+		return credentials{}, fmt.Errorf("no credentials for %s in %s", tenant, path)
+	}
+	return c, nil
+}
+
+// runCli runs the subcommand in args and returns the process exit code.
+func runCli(args []string, stdout, stderr io.Writer) int {
+	switch args[0] {
+	case "run":
+		return cliRun(args[1:], stdout, stderr)
+	case "queries":
+		if len(args) > 1 && args[1] == "help" {
+			fmt.Fprint(stdout, queriesUsage)
+			return exitOk
+		}
+		return cliQueries(args[1:], stdout, stderr)
+	case "tokens":
+		if len(args) > 1 && args[1] == "help" {
+			fmt.Fprint(stdout, tokensUsage)
+			return exitOk
+		}
+		return cliTokens(args[1:], stdout, stderr)
+	case "vault":
+		if len(args) > 1 && args[1] == "help" {
+			fmt.Fprint(stdout, vaultUsage)
+			return exitOk
+		}
+		return cliVault(args[1:], os.Stdin, stdout, stderr)
+	case "users":
+		if len(args) > 1 && args[1] == "help" {
+			fmt.Fprint(stdout, usersUsage)
+			return exitOk
+		}
+		return cliUsers(args[1:], os.Stdin, stdout, stderr)
+	case "audit":
+		if len(args) > 1 && args[1] == "help" {
+			fmt.Fprint(stdout, auditUsage)
+			return exitOk
+		}
+		return cliAudit(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		runFlags(stdout, nil).Usage()
+		return exitOk
+	}
+
+	fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+	runFlags(stderr, nil).Usage()
+	return exitUsage
+}
+
+type runOptions struct {
+	query       string
+	file        string
+	tenant      string
+	format      string
+	output      string
+	sqlite      sqliteTarget
+	sample      bool
+	full        bool
+	credentials string
+	cred        string
+	vault       string
+}
+
+func runFlags(out io.Writer, opts *runOptions) *flag.FlagSet {
+	if opts == nil {
+		opts = &runOptions{}
+	}
+
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.StringVar(&opts.query, "query", "", "name of the saved query to run")
+	fs.StringVar(&opts.file, "f", "", "file with the SQL to run, - for stdin")
+	fs.StringVar(&opts.tenant, "tenant", "", "tenant to run against (default the first configured tenant)")
+	fs.StringVar(&opts.format, "format", "csv", "output format: csv, xlsx, json or sqlite")
+	fs.StringVar(&opts.output, "o", "", "output file (default stdout)")
+	fs.StringVar(&opts.sqlite.Db, "db", "", "SQLite database under the configured sqlite dir, for -format sqlite")
+	fs.StringVar(&opts.sqlite.Table, "table", "", "table to load the result into, for -format sqlite")
+	fs.StringVar(&opts.sqlite.Mode, "mode", "append", "append to the table or replace it, for -format sqlite")
+	fs.BoolVar(&opts.sample, "sample", false, "only fetch the first 50 rows")
+	fs.BoolVar(&opts.full, "full", false, "run ad-hoc SQL unsampled on a tenant whose policy samples it")
+	fs.StringVar(&opts.credentials, "credentials", os.Getenv("EAM_CREDENTIALS"), "credentials file")
+	fs.StringVar(&opts.cred, "cred", os.Getenv("EAM_CRED"), "name of the vault entry to run as")
+	fs.StringVar(&opts.vault, "vault", defaultVaultPath(), "vault file")
+	fs.Usage = func() {
+		fmt.Fprint(out, cliUsage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// cliRun runs one query the way processQuery does and writes the result with
+// the same exporters.
+func cliRun(args []string, stdout, stderr io.Writer) int {
+	var opts runOptions
+	fs := runFlags(stderr, &opts)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOk
+		}
+		return exitUsage
+	}
+
+	fail := func(code int, format string, a ...any) int {
+		fmt.Fprintf(stderr, "go-server run: "+format+"\n", a...)
+		return code
+	}
+
+	var sql string
+	switch {
+	case (opts.query == "") == (opts.file == ""):
+		return fail(exitUsage, "give one of -query or -f")
+	case opts.query != "":
+		_, q, err := queries.load(opts.query)
+		if err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		sql = q
+	case opts.file == "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fail(exitUsage, "reading stdin: %v", err)
+		}
+		sql = string(data)
+	default:
+		data, err := os.ReadFile(opts.file)
+		if err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		sql = string(data)
+	}
+
+	switch opts.format {
+	case "csv", "xlsx", "json":
+	case "sqlite":
+		if err := opts.sqlite.validate(); err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		if opts.output != "" {
+			return fail(exitUsage, "-o does not apply to -format sqlite, give -db and -table")
+		}
+	default:
+		return fail(exitUsage, "unknown format %q", opts.format)
+	}
+
+	var creds credentials
+	if opts.cred != "" {
+		c, tenant, err := vaultCredentials(opts.vault, opts.cred)
+		if err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		creds = c
+		if opts.tenant == "" {
+			opts.tenant = tenant
+		}
+	}
+
+	if opts.tenant == "" && len(config.Tenants) > 0 {
+		opts.tenant = config.Tenants[0].Name
+	}
+	if _, ok := config.tenant(opts.tenant); !ok {
+		return fail(exitUsage, "unknown tenant %q", opts.tenant)
+	}
+
+	statements := splitStatements(sql)
+	if len(statements) != 1 {
+		return fail(exitUsage, "expected one statement, found %d", len(statements))
+	}
+
+	if opts.cred == "" {
+		c, err := loadCredentials(opts.credentials, opts.tenant)
+		if err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		creds = c
+	}
+
+	data := queryRequest{
+		Username: creds.Username,
+		Password: creds.Password,
+		Tenant:   opts.tenant,
+		Sample:   opts.sample,
+		Query:    statements[0],
+	}
+
+	if err := guardUnattended(&data, opts.full); err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+
+	run := startRun("")
+	rs, err := runResultSet(context.Background(), data, run)
+
+	entry := newHistoryEntry(historyRun, data, err)
+	entry.Rows = run.rowCount()
+	entry.DurationMs = time.Since(run.start).Milliseconds()
+	history.record(entry)
+	params := map[string]string{"sample": strconv.FormatBool(data.Sample)}
+	if opts.query != "" {
+		params["savedQuery"] = opts.query
+	}
+	if opts.cred != "" {
+		params["cred"] = opts.cred
+	}
+	auditExecution(nil, entry, opts.format, params)
+
+	var fault *eamFault
+	switch {
+	case errors.As(err, &fault):
+		return fail(exitFault, "EAM returned a fault: %s", strings.TrimSpace(fault.Message))
+	case err != nil:
+		return fail(exitTransport, "%v", err)
+	}
+
+	if opts.format == "sqlite" {
+		load, err := opts.sqlite.write(context.Background(), rs)
+		if err != nil {
+			return fail(exitUsage, "writing the result: %v", err)
+		}
+		if len(load.Added) > 0 || len(load.Retyped) > 0 {
+			fmt.Fprintf(stderr, "added columns %v, kept the existing types of %v\n", load.Added, load.Retyped)
+		}
+		fmt.Fprintf(stderr, "%d rows loaded into %s in %s in %dms\n", load.Rows, opts.sqlite.Table, opts.sqlite.path(), time.Since(run.start).Milliseconds())
+		return exitOk
+	}
+
+	out, closeOut := stdout, func() error { return nil }
+	if opts.output != "" {
+		f, err := os.Create(opts.output)
+		if err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		out, closeOut = f, f.Close
+	}
+
+	switch opts.format {
+	case "csv":
+		err = writeResultCsv(out, rs)
+	case "xlsx":
+		err = writeXlsx(out, []xlsxSheet{{Name: "data", Result: rs}})
+	case "json":
+		err = writeResultJson(out, rs)
+	}
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fail(exitUsage, "writing the result: %v", err)
+	}
+
+	fmt.Fprintf(stderr, "%d rows in %dms\n", len(rs.Rows), time.Since(run.start).Milliseconds())
+	return exitOk
+}
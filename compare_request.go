@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultComparison is the diff of one result against a baseline, such as a
+// tenant against the first tenant selected or a live run against a snapshot.
+type resultComparison struct {
+	// Base and Other are the tenants compared, set when Err is too.
+	Base  string
+	Other string
+	Diff  *resultDiff
+	Err   error
+}
+
+func processCompare(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	run := startRun(r.Form.Get("run-id"))
+
+	fail := func(err error, code int) {
+		run.failed(err)
+		errorResponse(w, err.Error(), code)
+	}
+
+	var data queryRequest
+	if err := validateQueryRequest(r, &data); err != nil {
+		fail(err, 400)
+		return
+	}
+
+	statements := splitStatements(data.Query)
+	if len(statements) != 1 {
+		fail(errors.New("compare mode needs exactly one statement"), 400)
+		return
+	}
+	data.Query = statements[0]
+
+	tenants := r.Form["compare-tenant"]
+	if len(tenants) < 2 {
+		fail(errors.New("select at least two tenants to compare"), 400)
+		return
+	}
+	for _, tenant := range tenants {
+		if _, ok := config.tenant(tenant); !ok {
+			fail(fmt.Errorf("unknown tenant %q", tenant), 400)
+			return
+		}
+	}
+
+	keys := parseKeyColumns(r.Form.Get("key"))
+	if len(keys) == 0 {
+		fail(errors.New("a key column is required to align rows"), 400)
+		return
+	}
+
+	if !guardQuery(w, r, data, tenants) {
+		run.finished(0, 0)
+		return
+	}
+
+	start := time.Now()
+	results := make([]*resultSet, len(tenants))
+	errs := make([]error, len(tenants))
+
+	var wg sync.WaitGroup
+	for i, tenant := range tenants {
+		wg.Add(1)
+		go func(i int, tenant string) {
+			defer wg.Done()
+
+			q := data
+			q.Tenant = tenant
+			results[i], errs[i] = runResultSet(r.Context(), q, run)
+
+			entry := newHistoryEntry(historyCompare, q, errs[i])
+			if results[i] != nil {
+				entry.Rows = len(results[i].Rows)
+			}
+			entry.DurationMs = time.Since(start).Milliseconds()
+			history.record(entry)
+			auditExecution(r, entry, "compare", map[string]string{"tenants": strings.Join(tenants, ","), "sample": strconv.FormatBool(q.Sample)})
+		}(i, tenant)
+	}
+	wg.Wait()
+	fmt.Printf("Compare time: %dms (%d tenants)\n", time.Since(start).Milliseconds(), len(tenants))
+
+	if errs[0] != nil {
+		fail(fmt.Errorf("%s: %w", tenants[0], errs[0]), limitedCode(w, errs[0], 500))
+		return
+	}
+
+	comparisons := make([]resultComparison, 0, len(tenants)-1)
+	for i := 1; i < len(tenants); i++ {
+		if errs[i] != nil {
+			comparisons = append(comparisons, resultComparison{Base: tenants[0], Other: tenants[i], Err: fmt.Errorf("%s: %w", tenants[i], errs[i])})
+			continue
+		}
+
+		diff, err := diffResultSets(results[0], results[i], keys)
+		if err != nil {
+			fail(err, 400)
+			return
+		}
+		diff.BaseLabel, diff.OtherLabel = tenants[0], tenants[i]
+		comparisons = append(comparisons, resultComparison{Base: tenants[0], Other: tenants[i], Diff: diff})
+	}
+
+	if r.Header.Get("X-Process-Type") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=compare.csv")
+
+		if err := writeDiffCsv(w, comparisons); err != nil {
+			fmt.Printf("[ERROR]: Compare csv export error: %v\n", err)
+			run.failed(err)
+			return
+		}
+	} else if err := renderDiffs(w, comparisons); err != nil {
+		run.failed(err)
+		return
+	}
+
+	run.finished(time.Since(start), 0)
+}
+
+func renderDiffs(w http.ResponseWriter, comparisons []resultComparison) error {
+	tmpl, err := template.ParseFiles("views/compare_results.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	if err = tmpl.Execute(w, comparisons); err != nil {
+		fmt.Printf("[ERROR]: Compare results template execution error: %v\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// writeDiffCsv writes every differing row with the side it came from, under
+// the columns of all the results. Cells that changed are written as
+// "old -> new", and a tenant that failed gets a row with its error.
+func writeDiffCsv(w io.Writer, comparisons []resultComparison) error {
+	// a column is the nth one of its name, so repeated names stay apart
+	type column struct {
+		name string
+		nth  int
+	}
+	var columns []column
+	positions := make([][]int, len(comparisons))
+	for i, c := range comparisons {
+		if c.Diff == nil {
+			continue
+		}
+		seen := map[string]int{}
+		for _, name := range c.Diff.Columns {
+			col := column{name, seen[name]}
+			seen[name]++
+
+			p := slices.Index(columns, col)
+			if p < 0 {
+				p = len(columns)
+				columns = append(columns, col)
+			}
+			positions[i] = append(positions[i], p)
+		}
+	}
+
+	cw := csv.NewWriter(w)
+
+	header := []string{"base", "compared", "change", "key", "error"}
+	for _, col := range columns {
+		header = append(header, col.name)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for i, c := range comparisons {
+		if c.Err != nil {
+			if err := cw.Write([]string{c.Base, c.Other, "failed", "", c.Err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, row := range c.Diff.Rows {
+			record := make([]string, 5+len(columns))
+			copy(record, []string{c.Diff.BaseLabel, c.Diff.OtherLabel, row.Change, row.Key})
+			for col, value := range row.Cells() {
+				if row.Change == rowChanged && row.Changed[col] {
+					value = row.Base[col] + " -> " + row.Other[col]
+				}
+				if col < len(positions[i]) {
+					record[5+positions[i][col]] = value
+				}
+			}
+
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+)
+
+const configPath = "config.json"
+
+type tenantConfig struct {
+	Name       string       `json:"name"`
+	Production bool         `json:"production"`
+	Policy     tenantPolicy `json:"policy"`
+}
+
+// serverConfig holds the settings read from config.json. Anything missing
+// from the file keeps its value from defaultConfig.
+type serverConfig struct {
+	Tenants      []tenantConfig    `json:"tenants"`
+	Snapshots    snapshotConfig    `json:"snapshots"`
+	CacheDir     string            `json:"cacheDir"`
+	DataDir      string            `json:"dataDir"`
+	Format       formatOptions     `json:"format"`
+	Lint         lintConfig        `json:"lint"`
+	Display      displayPrefs      `json:"display"`
+	ResultCache  resultCacheConfig `json:"resultCache"`
+	Sqlite       sqliteConfig      `json:"sqlite"`
+	Session      sessionConfig     `json:"session"`
+	SoapSessions soapSessionConfig `json:"soapSessions"`
+	Auth         authConfig        `json:"auth"`
+	Audit        auditConfig       `json:"audit"`
+	Limits       limitConfig       `json:"limits"`
+}
+
+// snapshotConfig controls where result snapshots are stored and how long
+// they are kept. Keep is per snapshot name; zero values disable that limit.
+type snapshotConfig struct {
+	Dir        string `json:"dir"`
+	Keep       int    `json:"keep"`
+	MaxAgeDays int    `json:"maxAgeDays"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() serverConfig {
+	return serverConfig{
+		Tenants: []tenantConfig{
+			{Name: "WASHGAS_TRN"},
+			{Name: "WASHGAS_PRD", Production: true, Policy: tenantPolicy{MaxRows: 100000, ForceSample: true, Confirm: true}},
+		},
+		Snapshots: snapshotConfig{
+			Dir:  "snapshots",
+			Keep: 20,
+		},
+		CacheDir: "cache",
+		DataDir:  "data",
+		Format: formatOptions{
+			KeywordCase: "upper",
+			Indent:      4,
+			CommaStyle:  "trailing",
+		},
+		Lint: lintConfig{
+			Rules: map[string]bool{
+				lintCartesianJoin: true,
+				lintSelectStar:    true,
+				lintMissingOrg:    true,
+				lintDateFunction:  true,
+				lintUnboundedPrd:  true,
+			},
+			HugeTables: []string{"R5EVENTS", "R5ACTIVITIES", "R5BOOKEDHOURS", "R5TRANSLINES", "R5AUDVALUES", "R5ADDETAILS", "R5PROPERTYVALUES"},
+			OrgColumns: map[string]string{
+				"R5EVENTS":  "EVT_ORG",
+				"R5OBJECTS": "OBJ_ORG",
+				"R5PARTS":   "PAR_ORG",
+				"R5PPMS":    "PPM_ORG",
+				"R5STORES":  "STR_ORG",
+			},
+			DateColumns: []string{"EVT_DATE", "EVT_DUE", "EVT_CREATED", "EVT_COMPLETED", "EVT_TARGET", "EVT_REPORTED", "BOO_DATE"},
+		},
+		Display: displayPrefs{
+			DateFormat:   "iso",
+			NumberLocale: "en-US",
+			BoolStyle:    "yes-no",
+		},
+		ResultCache: resultCacheConfig{
+			Clients: 50,
+			MaxRows: 50000,
+		},
+		Sqlite: sqliteConfig{
+			Binary: "sqlite3",
+			Dir:    "sqlite",
+		},
+		Session: sessionConfig{
+			IdleMinutes: 30,
+		},
+		SoapSessions: soapSessionConfig{
+			Reuse:       true,
+			MaxIdle:     4,
+			IdleMinutes: 20,
+		},
+		Limits: limitConfig{
+			PerTenant:           4,
+			PerUser:             2,
+			Queue:               20,
+			QueueTimeoutSeconds: 120,
+		},
+		Auth: authConfig{
+			Mode:           "local",
+			Header:         "X-Forwarded-User",
+			TrustedProxies: []string{"127.0.0.1/32", "::1/128"},
+			DefaultRole:    "viewer",
+			IdleMinutes:    480,
+		},
+	}
+}
+
+// loadConfig reads path over the defaults. A missing file is not an error.
+func loadConfig(path string) (serverConfig, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	} else if err != nil {
+		return cfg, err
+	}
+
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	switch cfg.Auth.Mode {
+	case "local", "header", "none":
+	default:
+		return cfg, fmt.Errorf("%s: auth.mode must be local, header or none, not %q", path, cfg.Auth.Mode)
+	}
+	if _, ok := parseRole(cfg.Auth.DefaultRole); !ok {
+		return cfg, fmt.Errorf("%s: unknown auth.defaultRole %q", path, cfg.Auth.DefaultRole)
+	}
+
+	return cfg, nil
+}
+
+func (c serverConfig) tenant(name string) (tenantConfig, bool) {
+	i := slices.IndexFunc(c.Tenants, func(t tenantConfig) bool { return t.Name == name })
+	if i < 0 {
+		return tenantConfig{}, false
+	}
+	return c.Tenants[i], true
+}
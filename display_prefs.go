@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// displayPrefs control how result values are shown in the browser. They are
+// kept per user in a cookie, with config.Display as the default.
+type displayPrefs struct {
+	// DateFormat is one of the keys of dateFormats, or "raw".
+	DateFormat string `json:"dateFormat"`
+	// NumberLocale is one of the keys of numberLocales, or "raw".
+	NumberLocale string `json:"numberLocale"`
+	// BoolStyle is one of the keys of boolStyles, or "raw".
+	BoolStyle string `json:"boolStyle"`
+}
+
+const displayPrefsCookie = "display-prefs"
+
+var dateFormats = map[string]string{
+	"iso": "2006-01-02",
+	"us":  "01/02/2006",
+	"eu":  "02/01/2006",
+	"dmy": "02-Jan-2006",
+}
+
+type numberLocale struct {
+	Group   string
+	Decimal string
+}
+
+var numberLocales = map[string]numberLocale{
+	"en-US": {Group: ",", Decimal: "."},
+	"de-DE": {Group: ".", Decimal: ","},
+	"fr-FR": {Group: " ", Decimal: ","},
+	"plain": {Group: "", Decimal: "."},
+}
+
+var boolStyles = map[string][2]string{
+	"yes-no":     {"Yes", "No"},
+	"true-false": {"true", "false"},
+	"check":      {"✓", "✗"},
+}
+
+// eamDateLayouts are the layouts EAM has been seen to return dates in.
+var eamDateLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC3339Nano,
+	"2006-01-02",
+	"02-Jan-06",
+	"02-JAN-06",
+}
+
+func displayPrefsFrom(r *http.Request) displayPrefs {
+	prefs := config.Display
+
+	c, err := r.Cookie(displayPrefsCookie)
+	if err != nil {
+		return prefs
+	}
+
+	values, err := url.ParseQuery(c.Value)
+	if err != nil {
+		return prefs
+	}
+
+	return prefs.with(values)
+}
+
+// with returns the preferences overridden by any valid values given.
+func (p displayPrefs) with(values url.Values) displayPrefs {
+	if v := values.Get("date"); v == "raw" || dateFormats[v] != "" {
+		p.DateFormat = v
+	}
+	if v := values.Get("number"); v == "raw" || numberLocales[v] != (numberLocale{}) {
+		p.NumberLocale = v
+	}
+	if v := values.Get("bool"); v == "raw" || boolStyles[v] != [2]string{} {
+		p.BoolStyle = v
+	}
+	return p
+}
+
+func (p displayPrefs) values() url.Values {
+	return url.Values{"date": {p.DateFormat}, "number": {p.NumberLocale}, "bool": {p.BoolStyle}}
+}
+
+// displayCell is a value formatted for the results table.
+type displayCell struct {
+	Text    string
+	Numeric bool
+}
+
+// format renders a raw EAM value of column c for display. Values that don't
+// parse as the column's type are shown unchanged.
+func (p displayPrefs) format(c columnMeta, raw string) displayCell {
+	cell := displayCell{Text: raw, Numeric: c.Numeric()}
+	if raw == "" {
+		return cell
+	}
+
+	switch c.kind() {
+	case kindNumber:
+		if loc, ok := numberLocales[p.NumberLocale]; ok {
+			cell.Text = formatNumber(raw, loc)
+		}
+	case kindDate:
+		layout, ok := dateFormats[p.DateFormat]
+		if t, err := parseEamDate(raw); ok && err == nil {
+			if t.Hour() != 0 || t.Minute() != 0 || t.Second() != 0 {
+				layout += " 15:04"
+			}
+			cell.Text = t.Format(layout)
+		}
+	case kindBool:
+		if words, ok := boolStyles[p.BoolStyle]; ok {
+			if b, ok := parseEamBool(raw); ok && b {
+				cell.Text = words[0]
+			} else if ok {
+				cell.Text = words[1]
+			}
+		}
+	}
+
+	return cell
+}
+
+// cells formats every value of rs.
+func (p displayPrefs) cells(rs *resultSet) [][]displayCell {
+	out := make([][]displayCell, len(rs.Rows))
+	for i, row := range rs.Rows {
+		out[i] = make([]displayCell, len(row))
+		for j, v := range row {
+			out[i][j] = p.format(rs.meta(j), v)
+		}
+	}
+	return out
+}
+
+// formatNumber regroups a plain decimal number for a locale. The digits are
+// never converted to a float, so no precision is lost.
+func formatNumber(raw string, loc numberLocale) string {
+	sign, digits := "", raw
+	if strings.HasPrefix(digits, "-") || strings.HasPrefix(digits, "+") {
+		sign, digits = digits[:1], digits[1:]
+	}
+
+	whole, frac, hasFrac := strings.Cut(digits, ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if strings.Trim(whole, "0123456789") != "" || strings.Trim(frac, "0123456789") != "" {
+		return raw
+	}
+
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(loc.Group)
+		}
+		b.WriteRune(d)
+	}
+	if hasFrac {
+		b.WriteString(loc.Decimal)
+		b.WriteString(frac)
+	}
+
+	return b.String()
+}
+
+func parseEamDate(raw string) (time.Time, error) {
+	var err error
+	for _, layout := range eamDateLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, raw); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// parseEamBool understands EAM's +/- checkbox values as well as the usual
+// spellings.
+func parseEamBool(raw string) (bool, bool) {
+	switch strings.ToLower(raw) {
+	case "+", "true", "1", "y", "yes":
+		return true, true
+	case "-", "false", "0", "n", "no":
+		return false, true
+	}
+	return false, false
+}
+
+// jsonNumberPattern is the number syntax of JSON.
+var jsonNumberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// jsonNumber returns raw as a number the JSON encoder accepts. Numbers JSON
+// spells differently, such as .5 or +1, are rewritten; raw is kept otherwise
+// so that no digits are lost.
+func jsonNumber(raw string) (json.Number, bool) {
+	if jsonNumberPattern.MatchString(raw) {
+		return json.Number(raw), true
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", false
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), true
+}
+
+// typedValue converts a raw value for the JSON and XLSX exports: numbers
+// become json.Number, dates time.Time and checkboxes bool. Empty values are
+// nil and anything that doesn't parse stays a string.
+func typedValue(c columnMeta, raw string) any {
+	if raw == "" {
+		return nil
+	}
+
+	switch c.kind() {
+	case kindNumber:
+		if n, ok := jsonNumber(raw); ok {
+			return n
+		}
+	case kindDate:
+		if t, err := parseEamDate(raw); err == nil {
+			return t
+		}
+	case kindBool:
+		if b, ok := parseEamBool(raw); ok {
+			return b
+		}
+	}
+
+	return raw
+}
+
+// settingsPage lists each choice of preference with an example of how it
+// displays.
+type settingsPage struct {
+	Prefs   displayPrefs
+	Dates   map[string]string
+	Numbers map[string]string
+	Bools   map[string]string
+	Saved   bool
+}
+
+func settings(w http.ResponseWriter, r *http.Request) {
+	renderSettings(w, r, settingsPage{Prefs: displayPrefsFrom(r)})
+}
+
+func saveSettings(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	prefs := displayPrefsFrom(r).with(r.Form)
+	http.SetCookie(w, &http.Cookie{
+		Name:     displayPrefsCookie,
+		Value:    prefs.values().Encode(),
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	renderSettings(w, r, settingsPage{Prefs: prefs, Saved: true})
+}
+
+func renderSettings(w http.ResponseWriter, r *http.Request, page settingsPage) {
+	example := time.Date(2024, time.March, 15, 0, 0, 0, 0, time.UTC)
+	page.Dates = map[string]string{"raw": "as returned by EAM"}
+	for key, layout := range dateFormats {
+		page.Dates[key] = example.Format(layout)
+	}
+	page.Numbers = map[string]string{"raw": "as returned by EAM"}
+	for key, loc := range numberLocales {
+		page.Numbers[key] = formatNumber("1234567.89", loc)
+	}
+	page.Bools = map[string]string{"raw": "+ / -"}
+	for key, words := range boolStyles {
+		page.Bools[key] = words[0] + " / " + words[1]
+	}
+
+	tmpl, err := template.ParseFiles("views/query_index.html", "views/settings.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := "query_index.html"
+	if r.Header.Get("HX-Request") == "true" {
+		name = "body"
+	}
+
+	if err = tmpl.ExecuteTemplate(w, name, page); err != nil {
+		fmt.Printf("[ERROR]: Settings template execution error: %v\n", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionConfig sets how long a login lasts without being used.
+type sessionConfig struct {
+	IdleMinutes int `json:"idleMinutes"`
+}
+
+const sessionCookie = "eam-session"
+
+// eamSession is a browser's EAM login, made by the go-server user owner.
+// The password is only held encrypted, with a key that lives in memory for
+// the life of the process.
+type eamSession struct {
+	Username string
+	owner    string
+	password string
+	used     time.Time
+}
+
+type sessionStore struct {
+	mu       sync.Mutex
+	gcm      cipher.AEAD
+	sessions map[string]*eamSession
+}
+
+var sessions = newSessionStore()
+
+func newSessionStore() *sessionStore {
+	key := make([]byte, 32)
+	rand.Read(key)
+	gcm, err := newGcm(key)
+	if err != nil {
+		panic(err)
+	}
+	return &sessionStore{gcm: gcm, sessions: map[string]*eamSession{}}
+}
+
+func (s *sessionStore) idle() time.Duration {
+	return time.Duration(max(config.Session.IdleMinutes, 1)) * time.Minute
+}
+
+// create starts a session for creds, logged in by owner, and returns its id.
+func (s *sessionStore) create(creds credentials, owner string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[id] = &eamSession{Username: creds.Username, owner: owner, password: sealWith(s.gcm, creds.Password), used: time.Now()}
+	return id
+}
+
+// get returns the credentials of a live session and who logged it in,
+// marking it used. Expired sessions are dropped along the way.
+func (s *sessionStore) get(id string) (credentials, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for sid, sess := range s.sessions {
+		if now.Sub(sess.used) > s.idle() {
+			delete(s.sessions, sid)
+		}
+	}
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return credentials{}, "", false
+	}
+	password, err := openWith(s.gcm, sess.password)
+	if err != nil {
+		return credentials{}, "", false
+	}
+
+	sess.used = now
+	return credentials{Username: sess.Username, Password: password}, sess.owner, true
+}
+
+func (s *sessionStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+}
+
+var errNotLoggedIn = errors.New("log in to EAM first, or your session has expired")
+
+// sessionCredentials returns the EAM credentials of the request's session.
+// A session only works for the go-server user who logged it in, so the next
+// person on a shared browser doesn't run as the previous one.
+func sessionCredentials(r *http.Request) (credentials, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return credentials{}, errNotLoggedIn
+	}
+
+	creds, owner, ok := sessions.get(c.Value)
+	if !ok || !strings.EqualFold(owner, requestUser(r).Name) {
+		return credentials{}, errNotLoggedIn
+	}
+	return creds, nil
+}
+
+func setSessionCookie(w http.ResponseWriter, id string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+type loginPanel struct {
+	Username string
+	Error    string
+}
+
+// loginStatus shows who the browser is logged in as, or the login form.
+func loginStatus(w http.ResponseWriter, r *http.Request) {
+	var panel loginPanel
+	if creds, err := sessionCredentials(r); err == nil {
+		panel.Username = creds.Username
+	}
+	renderLoginPanel(w, panel)
+}
+
+// login checks the credentials against EAM by running a trivial query on the
+// selected tenant, then starts a session for them.
+func login(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	creds := credentials{Username: strings.TrimSpace(r.Form.Get("username")), Password: r.Form.Get("password")}
+	tenant := r.Form.Get("tenant")
+	if creds.Username == "" || creds.Password == "" {
+		renderLoginPanel(w, loginPanel{Error: "enter a username and password"})
+		return
+	}
+	if _, ok := config.tenant(tenant); !ok {
+		renderLoginPanel(w, loginPanel{Error: fmt.Sprintf("unknown tenant %q", tenant)})
+		return
+	}
+
+	data := queryRequest{Username: creds.Username, Password: creds.Password, Tenant: tenant, Query: "SELECT 1 FROM DUAL"}
+	if _, err := runResultSet(r.Context(), data, nil); err != nil {
+		var fault *eamFault
+		msg := "EAM could not be reached: " + err.Error()
+		if errors.As(err, &fault) {
+			msg = "EAM rejected the login: " + fault.Message
+		}
+		renderLoginPanel(w, loginPanel{Error: msg})
+		return
+	}
+
+	setSessionCookie(w, sessions.create(creds, requestUser(r).Name), 0)
+	renderLoginPanel(w, loginPanel{Username: creds.Username})
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	endEamSession(w, r)
+	renderLoginPanel(w, loginPanel{})
+}
+
+// endEamSession forgets the browser's EAM login and closes its EAM sessions.
+func endEamSession(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if creds, _, ok := sessions.get(c.Value); ok {
+			soapSessions.closeUser(creds)
+		}
+		sessions.remove(c.Value)
+	}
+	setSessionCookie(w, "", -1)
+}
+
+func renderLoginPanel(w http.ResponseWriter, panel loginPanel) {
+	tmpl, err := template.ParseFiles("views/login_panel.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tmpl.Execute(w, panel); err != nil {
+		fmt.Printf("[ERROR]: Login template execution error: %v\n", err)
+	}
+}
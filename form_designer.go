@@ -20,7 +20,13 @@ func formDesignerIndex(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("[ERROR]: Form designer template parsing error: %v\n", err)
 	}
 
-	if err = tmpl.Execute(w, nil); err != nil {
+	if err = tmpl.Execute(w, formDesignerPage{User: requestUser(r)}); err != nil {
 		fmt.Printf("[ERROR]: Form designer template execution error: %v\n", err)
 	}
 }
+
+// formDesignerPage is the data of the form designer. The components take no
+// data, only the nav shows who is signed in.
+type formDesignerPage struct {
+	User appUser
+}
@@ -4,4 +4,18 @@ go 1.22.2
 
 require github.com/go-chi/chi/v5 v5.0.12
 
-require github.com/a-h/templ v0.2.543
+require (
+	github.com/a-h/templ v0.2.543
+	github.com/xuri/excelize/v2 v2.8.1
+	golang.org/x/crypto v0.19.0
+)
+
+require (
+	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826 // indirect
+	github.com/richardlehane/mscfb v1.0.4 // indirect
+	github.com/richardlehane/msoleps v1.0.3 // indirect
+	github.com/xuri/efp v0.0.0-20231025114914-d1ff6096ae53 // indirect
+	github.com/xuri/nfp v0.0.0-20230919160717-d98342af3f05 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
@@ -29,30 +29,81 @@ document.body.addEventListener("keyup", (e) => {
 });
 
 const csvDownloadBtn = /** @type {HTMLButtonElement} */ (document.querySelector("#csv-download"));
-csvDownloadBtn?.addEventListener("click", downloadCsv);
-async function downloadCsv() {
+csvDownloadBtn?.addEventListener("click", () => downloadExport("/csv", "csv"));
+const xlsxDownloadBtn = /** @type {HTMLButtonElement} */ (document.querySelector("#xlsx-download"));
+xlsxDownloadBtn?.addEventListener("click", () => downloadExport("/xlsx", "xlsx"));
+const jsonDownloadBtn = /** @type {HTMLButtonElement} */ (document.querySelector("#json-download"));
+jsonDownloadBtn?.addEventListener("click", () => downloadExport("/json", "json"));
+const compareCsvDownloadBtn = /** @type {HTMLButtonElement} */ (document.querySelector("#compare-csv-download"));
+compareCsvDownloadBtn?.addEventListener("click", () => downloadExport("/compare", "csv"));
+
+// export buttons inside a form post that form to its hx-post path, or their
+// data-export-path, with the export type and the name of the saved query
+document.body.addEventListener("click", async (e) => {
+    const button = /** @type {HTMLElement | null} */ (/** @type {HTMLElement} */ (e.target).closest?.("[data-export]"));
+    if (!button) {
+        return;
+    }
+
+    const form = /** @type {HTMLFormElement} */ (button.closest("form"));
+    const path = button.dataset.exportPath ?? /** @type {string} */ (form.getAttribute("hx-post"));
+    const body = new URLSearchParams(/** @type {any} */ (new FormData(form)));
+    if (!body.has("query-name")) {
+        body.set("query-name", savedQueryName());
+    }
+
+    const response = await fetch(path, {
+        method: "POST",
+        headers: {
+            "Content-Type": "application/x-www-form-urlencoded",
+            "X-Process-Type": /** @type {string} */ (button.dataset.export),
+        },
+        body: body,
+    });
+
+    if (!response.ok) {
+        alert("Failed to download " + button.dataset.export + "\n\nError: " + (await response.text()));
+        return;
+    }
+
+    await saveResponse(response);
+});
+
+/**
+ * Posts the query form to an export endpoint and saves the response as a file.
+ * @param {string} path
+ * @param {string} type
+ */
+async function downloadExport(path, type) {
     const form = /** @type {HTMLFormElement} */ (document.getElementById("query-form"));
     const formData = new FormData(form);
 
     formData.set("query", editor.getValue());
-    const response = await fetch("/csv", {
+    const response = await fetch(path, {
         method: "POST",
         headers: {
             "Content-Type": "application/x-www-form-urlencoded",
-            "X-Process-Type": "csv",
+            "X-Process-Type": type,
         },
         // @ts-ignore
         body: new URLSearchParams(formData),
     });
 
     if (!response.ok) {
-        alert("Failed to download csv\n\nError: " + (await response.text()));
+        alert("Failed to download " + type + "\n\nError: " + (await response.text()));
         return;
     }
 
+    await saveResponse(response);
+}
+
+/**
+ * Downloads a response body using the filename from its Content-Disposition header.
+ * @param {Response} response
+ */
+async function saveResponse(response) {
     const disposition = response.headers.get("Content-Disposition");
-    const filename =
-        disposition !== undefined ? /** @type {string} */ (disposition).split(";")[1].split("=")[1] : "download";
+    const filename = disposition ? disposition.split(";")[1].split("=")[1] : "download";
 
     const blob = await response.blob();
     const url = URL.createObjectURL(blob);
@@ -69,6 +120,126 @@ async function downloadCsv() {
     URL.revokeObjectURL(url);
 }
 
+/*  Result tabs  */
+
+document.body.addEventListener("click", (e) => {
+    const tab = /** @type {HTMLElement} */ (e.target)?.closest?.("[data-result-tab]");
+    if (!tab) {
+        return;
+    }
+
+    const container = /** @type {HTMLElement} */ (tab.closest("[data-result-tabs]"));
+    const index = /** @type {HTMLElement} */ (tab).dataset.resultTab;
+
+    container.querySelectorAll("[data-result-tab]").forEach((el) => {
+        /** @type {HTMLElement} */ (el).toggleAttribute("data-active", /** @type {HTMLElement} */ (el).dataset.resultTab === index);
+    });
+    container.querySelectorAll("[data-result-panel]").forEach((el) => {
+        /** @type {HTMLElement} */ (el).hidden = /** @type {HTMLElement} */ (el).dataset.resultPanel !== index;
+    });
+});
+
+/*  Schema browser  */
+
+document.body.addEventListener("click", (e) => {
+    const target = /** @type {HTMLElement} */ (e.target);
+
+    const insert = /** @type {HTMLElement | null} */ (target.closest?.("[data-insert]"));
+    if (insert) {
+        e.preventDefault();
+        editor.insert(insert.dataset.insert);
+        editor.focus();
+        return;
+    }
+
+    if (target.closest?.("[data-schema-close]")) {
+        /** @type {HTMLElement} */ (document.getElementById("schema-panel")).hidden = true;
+    }
+});
+
+// @ts-ignore
+document.body.addEventListener("htmx:afterSwap", function (/** @type {ResponseErrorEvent} */ e) {
+    if (e.detail.target.id === "schema-panel") {
+        e.detail.target.hidden = false;
+    }
+});
+
+/*  Formatting and saving  */
+
+/** Replaces the editor contents with the server's formatting of them. */
+async function formatEditor() {
+    const response = await fetch("/format", {
+        method: "POST",
+        body: new URLSearchParams({ sql: editor.getValue() }),
+    });
+
+    if (!response.ok) {
+        alert("Failed to format query\n\nError: " + (await response.text()));
+        return;
+    }
+
+    editor.setValue(await response.text(), -1);
+}
+
+/**
+ * Name of the saved query in the editor, or "" for a new query.
+ * @returns {string}
+ */
+function savedQueryName() {
+    const display = /** @type {HTMLSpanElement} */ (document.getElementById("query-display-name"));
+    return display.innerText === "New" ? "" : display.innerText;
+}
+
+document.body.addEventListener("query-saved", function (/** @type {CustomEvent} */ e) {
+    if (editor.getValue() !== e.detail.sql) {
+        editor.setValue(e.detail.sql, -1);
+    }
+    document.getElementById("save-popup")?.remove();
+});
+
+/*  Lint  */
+
+/** Checks the editor contents for common mistakes and lists them next to the Run button. */
+function lintQuery() {
+    // @ts-ignore
+    htmx.ajax("POST", "/lint", {
+        source: "#query-form",
+        target: "#lint-warnings",
+        values: { query: editor.getValue() },
+    });
+}
+
+/*  Run progress  */
+
+/**
+ * Subscribes to the server's progress stream for a run and mirrors it in the loading indicator.
+ * @param {string} runId
+ */
+function watchRunProgress(runId) {
+    const statusElement = /** @type {HTMLSpanElement} */ (document.getElementById("indicator-status"));
+    const source = new EventSource("/run/events/" + runId);
+
+    const seconds = (/** @type {number} */ ms) => (ms / 1000).toFixed(2) + " s";
+    const handle = (/** @type {string} */ type, /** @type {(data: any) => string} */ text) => {
+        source.addEventListener(type, (/** @type {MessageEvent} */ e) => {
+            statusElement.innerText = text(JSON.parse(e.data));
+        });
+    };
+
+    statusElement.innerText = "loading...";
+    handle("queued", (d) => "waiting for a turn on EAM, number " + d.position + " in line (" + seconds(d.elapsed) + ")");
+    handle("sent", (d) => "request sent, waiting on EAM... (" + seconds(d.elapsed) + ")");
+    handle("first-byte", (d) => "EAM responded, parsing... (" + seconds(d.elapsed) + ")");
+    handle("rows", (d) => d.rows + " rows parsed (" + seconds(d.elapsed) + ")");
+    handle("statement", (d) => d.message + " (" + seconds(d.elapsed) + ")");
+    handle("finished", (d) => d.rows + " rows, request " + d.requestMs + " ms, parse " + d.parseMs + " ms");
+    handle("failed", (d) => "failed: " + d.message);
+
+    source.addEventListener("finished", () => source.close());
+    source.addEventListener("failed", () => source.close());
+    source.onerror = () => source.close();
+}
+
 /*  HTMX listeners  */
 
 // @ts-ignore
@@ -81,9 +252,71 @@ document.body.addEventListener("htmx:beforeRequest", function (/** @type {Respon
     e.detail.xhr["startTime"] = e.timeStamp;
 });
 
+// requests that run a query: they get the editor contents and a progress stream
+const trackedPaths = ["/run", "/compare", "/snapshots"];
+
+// @ts-ignore
+document.body.addEventListener("htmx:configRequest", function (/** @type {CustomEvent} */ e) {
+    if (e.detail.verb !== "post" || !trackedPaths.includes(e.detail.path)) {
+        return;
+    }
+
+    e.detail.parameters["query"] = editor.getValue();
+
+    const runId = crypto.randomUUID();
+    e.detail.parameters["run-id"] = runId;
+    watchRunProgress(runId);
+    lintQuery();
+});
+
+// htmx swaps only once the whole response is in, so the rows the server
+// flushes of a run are shown as they arrive until then
+// @ts-ignore
+document.body.addEventListener("htmx:beforeSend", function (/** @type {ResponseErrorEvent} */ e) {
+    if (e.detail.pathInfo.requestPath !== "/run") {
+        return;
+    }
+
+    const xhr = e.detail.xhr;
+    const target = e.detail.target;
+    /** @type {HTMLTableElement | null} */
+    let table = null;
+    let shown = 0;
+
+    xhr.addEventListener("progress", () => {
+        if (xhr.status !== 200) {
+            return;
+        }
+
+        const text = xhr.responseText;
+        if (!table) {
+            const body = text.indexOf("<tbody>");
+            if (body < 0) {
+                return;
+            }
+            shown = body + "<tbody>".length;
+            target.innerHTML = text.slice(0, shown);
+            table = target.querySelector("table");
+            if (!table) {
+                return;
+            }
+        }
+
+        const end = text.lastIndexOf("</tr>") + "</tr>".length;
+        if (end <= shown) {
+            return;
+        }
+
+        const rows = document.createElement("template");
+        rows.innerHTML = "<table><tbody>" + text.slice(shown, end) + "</tbody></table>";
+        table.append(/** @type {HTMLElement} */ (rows.content.querySelector("tbody")));
+        shown = end;
+    });
+});
+
 // @ts-ignore
 document.body.addEventListener("htmx:afterRequest", function (/** @type {ResponseErrorEvent} */ e) {
-    if (e.detail.pathInfo.requestPath === "/run") {
+    if (trackedPaths.includes(e.detail.pathInfo.requestPath)) {
         const diff = e.timeStamp - e.detail.xhr["startTime"];
         const time = diff < 1000 ? Math.floor(diff) : (diff / 1000).toFixed(2);
         const timeUnits = diff < 1000 ? " ms" : " s";
@@ -105,6 +338,31 @@ document.body.addEventListener("htmx:afterRequest", function (/** @type {Respons
 
 /*  Ace Editor Config  */
 
+/** Completer backed by the server's cached schema, snippets and query history. */
+const serverCompleter = {
+    identifierRegexps: [/[a-zA-Z_0-9$#]/],
+    /**
+     * @param {any} editor
+     * @param {any} session
+     * @param {{row: number, column: number}} pos
+     * @param {string} prefix
+     * @param {(err: any, completions: any[]) => void} callback
+     */
+    getCompletions(editor, session, pos, prefix, callback) {
+        const tenant = /** @type {HTMLSelectElement} */ (document.querySelector("[name=tenant]")).value;
+        const body = new URLSearchParams({
+            tenant: tenant,
+            sql: session.getValue(),
+            pos: String(session.doc.positionToIndex(pos)),
+        });
+
+        fetch("/complete", { method: "POST", body: body })
+            .then((response) => (response.ok ? response.json() : []))
+            .then((completions) => callback(null, completions ?? []))
+            .catch(() => callback(null, []));
+    },
+};
+
 let roEditor;
 let editor;
 try {
@@ -119,6 +377,17 @@ try {
     editor.session.setMode("ace/mode/sql");
     editor.session.setUseWrapMode(true);
     editor.renderer.setScrollMargin(5, 0);
+
+    // @ts-ignore
+    const langTools = ace.require("ace/ext/language_tools");
+    editor.setOptions({ enableBasicAutocompletion: true, enableLiveAutocompletion: true });
+    editor.completers = [serverCompleter, langTools.keyWordCompleter];
+
+    editor.commands.addCommand({
+        name: "formatSql",
+        bindKey: { win: "Ctrl-Shift-F", mac: "Command-Shift-F" },
+        exec: formatEditor,
+    });
 } catch {}
 
 /**
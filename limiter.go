@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limitConfig caps the queries running on EAM at once. A query over either
+// cap waits in a queue of at most Queue queries per tenant, for at most
+// QueueTimeoutSeconds; past that it is turned away with a 429. Zero caps
+// don't limit.
+type limitConfig struct {
+	PerTenant           int `json:"perTenant"`
+	PerUser             int `json:"perUser"`
+	Queue               int `json:"queue"`
+	QueueTimeoutSeconds int `json:"queueTimeoutSeconds"`
+}
+
+// errBusy is returned when a query doesn't get its turn on EAM.
+type errBusy struct {
+	tenant     string
+	retryAfter time.Duration
+}
+
+func (e *errBusy) Error() string {
+	return fmt.Sprintf("too many queries are running on %s, try again in %d s", e.tenant, e.seconds())
+}
+
+func (e *errBusy) seconds() int {
+	return max(int(math.Ceil(e.retryAfter.Seconds())), 1)
+}
+
+// limitedCode sets Retry-After and returns 429 when err is a query turned
+// away by the limiter, or returns code otherwise.
+func limitedCode(w http.ResponseWriter, err error, code int) int {
+	var busy *errBusy
+	if !errors.As(err, &busy) {
+		return code
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(busy.seconds()))
+	return http.StatusTooManyRequests
+}
+
+type limitWaiter struct {
+	tenant  string
+	user    string
+	run     *runTracker
+	ready   chan struct{}
+	granted bool
+}
+
+// eamLimiter hands out turns on EAM. Waiters are served in order, but one
+// held back by its user's cap doesn't hold up the users behind it, so a user
+// firing off a burst of runs only ever waits on themselves.
+type eamLimiter struct {
+	mu      sync.Mutex
+	tenants map[string]int
+	users   map[string]int
+	queue   []*limitWaiter
+	// held is the average time a turn is held per tenant, for Retry-After
+	held map[string]time.Duration
+}
+
+var eamLimits = newEamLimiter()
+
+func newEamLimiter() *eamLimiter {
+	l := &eamLimiter{tenants: map[string]int{}, users: map[string]int{}, held: map[string]time.Duration{}}
+	metrics.gauge("eam_queries_running", func() float64 { return float64(l.running()) })
+	metrics.gauge("eam_queries_queued", func() float64 { return float64(l.queued()) })
+	return l
+}
+
+func (l *eamLimiter) running() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for _, c := range l.tenants {
+		n += c
+	}
+	return n
+}
+
+func (l *eamLimiter) queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.queue)
+}
+
+// limitUser is who a query counts against: the signed in user, the API
+// token, or else the EAM user. Without sign in everyone is the same
+// anonymous user, so the EAM user is used then too.
+func limitUser(ctx context.Context, data queryRequest) string {
+	if u, ok := ctx.Value(appUserKey{}).(appUser); ok && u.Name != "" && config.Auth.Mode != "none" {
+		return u.Name
+	}
+	if t, ok := ctx.Value(apiTokenKey{}).(apiToken); ok && t.Id != "" {
+		return "token:" + t.Name
+	}
+	return data.Username
+}
+
+func (l *eamLimiter) free(tenant, user string) bool {
+	limits := config.Limits
+	return (limits.PerTenant <= 0 || l.tenants[tenant] < limits.PerTenant) &&
+		(limits.PerUser <= 0 || l.users[user] < limits.PerUser)
+}
+
+func (l *eamLimiter) take(tenant, user string) {
+	l.tenants[tenant]++
+	l.users[user]++
+}
+
+// acquire waits for a turn to run a query on tenant and returns the function
+// that gives it back. The run is told its place in the queue meanwhile.
+func (l *eamLimiter) acquire(ctx context.Context, tenant, user string, run *runTracker) (func(), error) {
+	l.mu.Lock()
+	if l.free(tenant, user) {
+		l.take(tenant, user)
+		l.mu.Unlock()
+		return l.releaser(tenant, user), nil
+	}
+
+	waiting := 0
+	for _, w := range l.queue {
+		if w.tenant == tenant {
+			waiting++
+		}
+	}
+	if waiting >= config.Limits.Queue {
+		err := &errBusy{tenant: tenant, retryAfter: l.retryAfter(tenant, waiting)}
+		l.mu.Unlock()
+		metrics.add("eam_queries_rejected_total", fmt.Sprintf("tenant=%q", tenant), 1)
+		return nil, err
+	}
+
+	w := &limitWaiter{tenant: tenant, user: user, run: run, ready: make(chan struct{})}
+	l.queue = append(l.queue, w)
+	l.announce()
+	l.mu.Unlock()
+
+	timeout := time.NewTimer(time.Duration(max(config.Limits.QueueTimeoutSeconds, 1)) * time.Second)
+	defer timeout.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return l.releaser(tenant, user), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout.C:
+		metrics.add("eam_queries_rejected_total", fmt.Sprintf("tenant=%q", tenant), 1)
+		err = &errBusy{tenant: tenant}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if w.granted {
+		// the turn came as we gave up, pass it on
+		l.give(tenant, user, 0)
+		return nil, err
+	}
+	for i, queued := range l.queue {
+		if queued == w {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			break
+		}
+	}
+	if busy, ok := err.(*errBusy); ok {
+		busy.retryAfter = l.retryAfter(tenant, len(l.queue))
+	}
+	l.announce()
+	return nil, err
+}
+
+func (l *eamLimiter) releaser(tenant, user string) func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.give(tenant, user, time.Since(start))
+		})
+	}
+}
+
+// give returns a turn and hands free turns to the queue. Called with l.mu
+// held.
+func (l *eamLimiter) give(tenant, user string, held time.Duration) {
+	l.tenants[tenant]--
+	l.users[user]--
+	if l.users[user] == 0 {
+		delete(l.users, user)
+	}
+	if held > 0 {
+		if avg, ok := l.held[tenant]; ok {
+			held = (avg*4 + held) / 5
+		}
+		l.held[tenant] = held
+	}
+
+	queue := l.queue[:0]
+	for _, w := range l.queue {
+		if l.free(w.tenant, w.user) {
+			l.take(w.tenant, w.user)
+			w.granted = true
+			close(w.ready)
+			continue
+		}
+		queue = append(queue, w)
+	}
+	l.queue = queue
+	l.announce()
+}
+
+// announce tells every waiting run its place in its tenant's queue. Called
+// with l.mu held.
+func (l *eamLimiter) announce() {
+	places := map[string]int{}
+	for _, w := range l.queue {
+		places[w.tenant]++
+		w.run.publish(runEvent{Type: runEventQueued, Position: places[w.tenant]})
+	}
+}
+
+// retryAfter guesses when a turn frees up on tenant with waiting queries
+// ahead. Called with l.mu held.
+func (l *eamLimiter) retryAfter(tenant string, waiting int) time.Duration {
+	held, ok := l.held[tenant]
+	if !ok {
+		held = 5 * time.Second
+	}
+	return held * time.Duration(waiting+1) / time.Duration(max(config.Limits.PerTenant, 1))
+}
+
+// limitedBody gives the turn back once the response has been read.
+type limitedBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,56 @@
+//go:build !unix
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+)
+
+// lockFile creates the lock file at path with this process's PID, waiting up
+// to wait for another process to release it. A lock file whose process is
+// gone is taken over. The returned func releases it.
+func lockFile(path string, wait time.Duration) (func(), error) {
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		if data, err := os.ReadFile(path); err == nil && len(bytes.TrimSpace(data)) > 0 {
+			pid, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+			if err != nil || !processAlive(pid) {
+				// only take over the lock file that was read
+				if again, _ := os.ReadFile(path); bytes.Equal(again, data) {
+					os.Remove(path)
+					continue
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errLocked
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -26,6 +32,29 @@ var (
 )
 
 func main() {
+	cli := len(os.Args) > 1
+	stdout := os.Stdout
+	if cli {
+		// stdout is kept for the result, anything else printed goes to stderr
+		os.Stdout = os.Stderr
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Printf("[ERROR]: Config load error: %v\n", err)
+		if cli {
+			os.Exit(exitUsage)
+		}
+		return
+	}
+	config = cfg
+
+	if cli {
+		// a one-off command would leave a reused EAM session open behind it
+		config.SoapSessions.Reuse = false
+		os.Exit(runCli(os.Args[1:], stdout, os.Stderr))
+	}
+
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 
@@ -33,20 +62,97 @@ func main() {
 	FileServer(r, "/js", jsFS)
 	FileServer(r, "/assets", assetsFS)
 
-	r.Get("/", GetIndex)
-	r.Get("/settings", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte("<h1>SETTINGS</h1>"))
+	r.Get("/signin", signinForm)
+	r.Post("/signin", signin)
+	r.Route("/api/v1", apiRoutes)
+	r.Get("/metrics", serveMetrics)
+
+	r.Group(func(r chi.Router) {
+		r.Use(authenticate)
+
+		r.Get("/", GetIndex)
+		r.Post("/signout", signout)
+		r.Get("/login", loginStatus)
+		r.Post("/login", login)
+		r.Post("/logout", logout)
+		r.Get("/settings", settings)
+		r.Post("/settings", saveSettings)
+
+		r.Get("/run/events/{id}", runEvents)
+		r.Get("/result/view", resultViewShow)
+		r.Post("/result/view", resultViewUpdate)
+		r.Get("/result/summary", resultSummary)
+		r.Post("/result/summary", resultSummary)
+		r.Get("/result/chart", resultChart)
+		r.Post("/result/chart", resultChart)
+		r.Get("/result/chart.svg", resultChartSvg)
+		r.Post("/result/report", resultReport)
+		r.Post("/result/sqlite", resultSqlite)
+		r.Get("/snapshots", snapshotList)
+		r.Post("/snapshots/{id}/diff", snapshotDiff)
+		r.Get("/query/open", openQueries)
+
+		r.Group(func(r chi.Router) {
+			r.Use(queryAccess)
+			r.Post("/run", processQuery)
+			r.Post("/csv", processQuery)
+			r.Post("/xlsx", processQuery)
+			r.Post("/json", processQuery)
+			r.Post("/compare", processCompare)
+			r.Post("/snapshots", processSnapshot)
+			r.Post("/approvals", requestApproval)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAnalyst))
+			r.Delete("/snapshots/{id}", snapshotRemove)
+			r.Get("/schema", schemaBrowser)
+			r.Post("/schema/refresh", schemaRefresh)
+			r.Post("/complete", completeSql)
+			r.Post("/format", formatQuery)
+			r.Post("/lint", lintQuery)
+			r.Get("/query/save", saveQuery)
+			r.Post("/query/save", submitSavedQuery)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleProdAnalyst))
+			r.Get("/approvals", approvalList)
+			r.Post("/approvals/{id}/approve", decideApproval(true))
+			r.Post("/approvals/{id}/reject", decideApproval(false))
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAdmin))
+			r.Get("/form_designer", formDesignerIndex)
+			r.Get("/audit", auditSearch)
+		})
 	})
 
-	r.Post("/run", processQuery)
-	r.Post("/csv", processQuery)
-	r.Get("/query/open", openQueries)
-	r.Get("/query/save", saveQuery)
-	r.Get("/form_designer", formDesignerIndex)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: ":42069", Handler: r}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
 
-	err := http.ListenAndServe(":42069", r)
-	fmt.Printf("[ERROR]: Server shutdown with error: %v", err)
+	err = server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		fmt.Printf("[ERROR]: Server shutdown with error: %v", err)
+		return
+	}
+
+	// EAM sessions kept for reuse would otherwise stay open until they time out
+	<-drained
+	closing, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	soapSessions.closeAll(closing)
 }
 
 func GetIndex(w http.ResponseWriter, r *http.Request) {
@@ -56,12 +162,20 @@ func GetIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = tmpl.Execute(w, nil); err != nil {
+	page := indexPage{serverConfig: config, User: requestUser(r)}
+	if err = tmpl.Execute(w, page); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+// indexPage is the query screen: the config, for the tenants, and who is
+// signed in.
+type indexPage struct {
+	serverConfig
+	User appUser
+}
+
 func FileServer(r chi.Router, path string, root http.Handler) {
 	if strings.ContainsAny(path, "{}*") {
 		panic("FileServer does not permit any URL parameters.")
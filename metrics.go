@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry keeps the counters and histograms served at /metrics in
+// the Prometheus text format. Labels are passed preformatted, e.g.
+// `scenario="start"`.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   map[metricKey]float64
+	histograms map[metricKey]*histogram
+	gauges     map[string]func() float64
+}
+
+type metricKey struct {
+	name   string
+	labels string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// latencyBuckets are the histogram bounds, in seconds.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metricDefs are the metrics served, in order.
+var metricDefs = []struct {
+	name, kind, help string
+}{
+	{"eam_request_duration_seconds", "histogram", "Time until EAM answers a SOAP request, by session scenario. terminate is a one-off login, continue reuses a session."},
+	{"eam_session_renewals_total", "counter", "EAM sessions restarted after an expiry fault."},
+	{"eam_sessions_idle", "gauge", "EAM sessions kept open for reuse."},
+	{"eam_queries_running", "gauge", "Queries holding a turn on EAM."},
+	{"eam_queries_queued", "gauge", "Queries waiting for a turn on EAM."},
+	{"eam_queries_rejected_total", "counter", "Queries turned away because the queue of their tenant was full or they waited too long, by tenant."},
+}
+
+var metrics = &metricsRegistry{
+	counters:   map[metricKey]float64{},
+	histograms: map[metricKey]*histogram{},
+	gauges:     map[string]func() float64{},
+}
+
+func (m *metricsRegistry) add(name, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[metricKey{name, labels}] += v
+}
+
+func (m *metricsRegistry) observe(name, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.histograms[metricKey{name, labels}]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.histograms[metricKey{name, labels}] = h
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *metricsRegistry) gauge(name string, fn func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gauges[name] = fn
+}
+
+func labelled(name, labels, extra string) string {
+	all := strings.Trim(labels+","+extra, ",")
+	if all == "" {
+		return name
+	}
+	return name + "{" + all + "}"
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	m := metrics
+
+	// gauges are read first, as they may take other locks
+	m.mu.Lock()
+	gauges := maps.Clone(m.gauges)
+	m.mu.Unlock()
+	gaugeValues := map[string]float64{}
+	for name, fn := range gauges {
+		gaugeValues[name] = fn()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	for _, def := range metricDefs {
+		name, kind, help := def.name, def.kind, def.help
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+
+		switch kind {
+		case "counter":
+			for _, k := range sortedKeys(m.counters, name) {
+				fmt.Fprintf(&b, "%s %g\n", labelled(name, k.labels, ""), m.counters[k])
+			}
+		case "histogram":
+			for _, k := range sortedKeys(m.histograms, name) {
+				h := m.histograms[k]
+				for i, bound := range latencyBuckets {
+					fmt.Fprintf(&b, "%s %d\n", labelled(name+"_bucket", k.labels, fmt.Sprintf(`le="%g"`, bound)), h.counts[i])
+				}
+				fmt.Fprintf(&b, "%s %d\n", labelled(name+"_bucket", k.labels, `le="+Inf"`), h.count)
+				fmt.Fprintf(&b, "%s %g\n", labelled(name+"_sum", k.labels, ""), h.sum)
+				fmt.Fprintf(&b, "%s %d\n", labelled(name+"_count", k.labels, ""), h.count)
+			}
+		case "gauge":
+			if v, ok := gaugeValues[name]; ok {
+				fmt.Fprintf(&b, "%s %g\n", name, v)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// sortedKeys returns the keys of m for the named metric, ordered by labels.
+func sortedKeys[V any](m map[metricKey]V, name string) []metricKey {
+	var keys []metricKey
+	for k := range m {
+		if k.name == name {
+			keys = append(keys, k)
+		}
+	}
+	slices.SortFunc(keys, func(a, b metricKey) int { return strings.Compare(a.labels, b.labels) })
+	return keys
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tenantPolicy guards a tenant against expensive or unreviewed queries.
+// MaxRows caps every query on the tenant. The rest only applies to ad-hoc
+// SQL, not to saved queries: ForceSample runs it sampled unless the user
+// overrides that, Confirm shows the SQL as it will run and an estimated row
+// count before a full run, and RequireApproval needs a second user to approve
+// the SQL before it runs at all.
+type tenantPolicy struct {
+	MaxRows         int  `json:"maxRows"`
+	ForceSample     bool `json:"forceSample"`
+	Confirm         bool `json:"confirm"`
+	RequireApproval bool `json:"requireApproval"`
+}
+
+func policyFor(tenant string) tenantPolicy {
+	t, _ := config.tenant(tenant)
+	return t.Policy
+}
+
+// sampleRows is how many rows a sampled query returns.
+const sampleRows = 50
+
+// expandedSql is the SQL as it is sent to EAM, limited to the sample or to
+// the tenant's maximum row count.
+func (data queryRequest) expandedSql() string {
+	switch maxRows := policyFor(data.Tenant).MaxRows; {
+	case data.Sample:
+		return fmt.Sprintf("SELECT * FROM (%s) WHERE ROWNUM <= %d", data.Query, sampleRows)
+	case maxRows > 0 && !data.Unlimited:
+		return fmt.Sprintf("SELECT * FROM (%s) WHERE ROWNUM <= %d", data.Query, maxRows)
+	}
+	return data.Query
+}
+
+// confirmToken identifies what a confirmation was given for, so that it
+// doesn't carry over to changed SQL.
+func confirmToken(data queryRequest, tenants []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(tenants, ",") + "\n" + data.Query))
+	return hex.EncodeToString(sum[:16])
+}
+
+// guardPanel is shown instead of running a query that needs a confirmation
+// or an approval first. Its buttons post the query form to Path again.
+type guardPanel struct {
+	Tenant      string
+	Path        string
+	Target      string
+	Query       string
+	Sql         string
+	Policy      tenantPolicy
+	Estimate    string
+	Token       string
+	Approval    *approval
+	NeedsReview bool
+	FullOnly    bool
+}
+
+// errNeedsGuard is returned to export requests, which can't show the panel.
+var errNeedsGuard = errors.New("this query needs a confirmation or approval first, run it on screen")
+
+// guardQuery applies the policies of tenants to a web request running ad-hoc
+// SQL. It returns false when it has written a confirmation or approval panel,
+// or an error, instead.
+func guardQuery(w http.ResponseWriter, r *http.Request, data queryRequest, tenants []string) bool {
+	return guard(w, r, data, tenants, false)
+}
+
+// guardRerun is guardQuery for re-running a query whose sample setting can't
+// change, so its panel offers no sampled run.
+func guardRerun(w http.ResponseWriter, r *http.Request, data queryRequest, tenants []string) bool {
+	return guard(w, r, data, tenants, true)
+}
+
+func guard(w http.ResponseWriter, r *http.Request, data queryRequest, tenants []string, fullOnly bool) bool {
+	var guarded []string
+	for _, t := range tenants {
+		if p := policyFor(t); p.ForceSample || p.Confirm || p.RequireApproval {
+			guarded = append(guarded, t)
+		}
+	}
+	if len(guarded) == 0 {
+		return true
+	}
+
+	saved, err := isSavedSql(data.Query)
+	if err != nil {
+		errorResponse(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if saved {
+		return true
+	}
+
+	panel := guardPanel{
+		Path:     r.URL.Path,
+		Target:   "#" + cmp.Or(r.Header.Get("HX-Target"), "data"),
+		Token:    confirmToken(data, tenants),
+		FullOnly: fullOnly,
+	}
+
+	for _, t := range guarded {
+		p := policyFor(t)
+		panel.Tenant, panel.Policy = t, p
+
+		if p.RequireApproval {
+			a, ok, err := approvals.find(t, data.Query)
+			if err != nil {
+				errorResponse(w, err.Error(), http.StatusInternalServerError)
+				return false
+			}
+			if !ok || a.Status != approvalApproved {
+				if ok {
+					panel.Approval = &a
+				}
+				panel.NeedsReview = true
+				return renderGuard(w, r, data, panel)
+			}
+		}
+	}
+
+	// the sampled run is harmless, a full one needs the override
+	full := r.Form.Get("full") == "true" && r.Form.Get("confirmed") == panel.Token
+	if data.Sample || full {
+		return true
+	}
+
+	needsFull := false
+	for _, t := range guarded {
+		p := policyFor(t)
+		if p.ForceSample || p.Confirm {
+			panel.Tenant, panel.Policy = t, p
+			needsFull = true
+			break
+		}
+	}
+	if !needsFull {
+		return true
+	}
+
+	if panel.Policy.Confirm {
+		q := data
+		q.Tenant = panel.Tenant
+		panel.Estimate = estimateRows(r, q)
+	}
+	return renderGuard(w, r, data, panel)
+}
+
+// estimateRows counts the rows of the query on EAM, giving up after a while.
+func estimateRows(r *http.Request, data queryRequest) string {
+	ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+	defer cancel()
+
+	statements := splitStatements(data.Query)
+	if len(statements) != 1 {
+		return "unknown"
+	}
+
+	q := data
+	q.Sample = false
+	q.Query = fmt.Sprintf("SELECT COUNT(*) FROM (%s)", statements[0])
+	rs, err := runResultSet(ctx, q, nil)
+
+	entry := newHistoryEntry(historyRun, q, err)
+	if err == nil {
+		entry.Rows = len(rs.Rows)
+	}
+	auditExecution(r, entry, "estimate", nil)
+
+	if err != nil || len(rs.Rows) != 1 || len(rs.Rows[0]) != 1 {
+		return "unknown"
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(rs.Rows[0][0])); err == nil {
+		return strconv.Itoa(n)
+	}
+	return "unknown"
+}
+
+func renderGuard(w http.ResponseWriter, r *http.Request, data queryRequest, panel guardPanel) bool {
+	if r.Header.Get("X-Process-Type") != "" {
+		errorResponse(w, errNeedsGuard.Error(), http.StatusConflict)
+		return false
+	}
+
+	var expanded []string
+	for _, stmt := range splitStatements(data.Query) {
+		q := data
+		q.Tenant, q.Sample, q.Query = panel.Tenant, false, stmt
+		expanded = append(expanded, q.expandedSql())
+	}
+	panel.Query, panel.Sql = data.Query, strings.Join(expanded, ";\n\n")
+
+	tmpl, err := template.ParseFiles("views/guard_panel.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if err = tmpl.Execute(w, panel); err != nil {
+		fmt.Printf("[ERROR]: Guard template execution error: %v\n", err)
+	}
+	return false
+}
+
+var errApprovalRequired = errors.New("this tenant runs ad-hoc SQL only after another user has approved it on the Approvals page")
+
+// guardUnattended applies the policy of data's tenant to ad-hoc SQL run
+// through the API or the command line, where there is no panel to confirm
+// on: it runs sampled unless full is set, and not at all without a needed
+// approval.
+func guardUnattended(data *queryRequest, full bool) error {
+	p := policyFor(data.Tenant)
+	if !p.ForceSample && !p.RequireApproval {
+		return nil
+	}
+
+	saved, err := isSavedSql(data.Query)
+	if err != nil || saved {
+		return err
+	}
+
+	ok, err := approvals.approved(data.Tenant, data.Query)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errApprovalRequired
+	}
+
+	if p.ForceSample && !full {
+		data.Sample = true
+	}
+	return nil
+}
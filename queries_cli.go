@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const queriesUsage = `Usage of queries:
+  go-server queries list
+  go-server queries show NAME
+  go-server queries add [-f FILE] [-d DESCRIPTION] NAME   SQL from FILE or stdin
+  go-server queries rm NAME
+  go-server queries mv NAME NEW-NAME
+  go-server queries export [-o FILE]
+  go-server queries import [-replace] FILE
+  go-server queries check [-repair]
+
+The commands that change the library lock it, so they can run while the server
+is up.
+`
+
+// queryExport is one query of an export bundle.
+type queryExport struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Chart       *chartConfig `json:"chart,omitempty"`
+	Sql         string       `json:"sql"`
+}
+
+// cliQueries manages the saved query library and returns the exit code.
+func cliQueries(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, queriesUsage)
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("queries "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, queriesUsage) }
+	file := fs.String("f", "", "")
+	description := fs.String("d", "", "")
+	output := fs.String("o", "", "")
+	replace := fs.Bool("replace", false, "")
+	repair := fs.Bool("repair", false, "")
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOk
+		}
+		return exitUsage
+	}
+
+	fail := func(format string, a ...any) int {
+		fmt.Fprintf(stderr, "go-server queries %s: "+format+"\n", append([]any{args[0]}, a...)...)
+		return exitUsage
+	}
+	argc := map[string]int{"list": 0, "show": 1, "add": 1, "rm": 1, "mv": 2, "export": 0, "import": 1, "check": 0}
+	if n, ok := argc[args[0]]; !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], queriesUsage)
+		return exitUsage
+	} else if fs.NArg() != n {
+		fmt.Fprint(stderr, queriesUsage)
+		return exitUsage
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		var index []savedQuery
+		if index, err = queries.list(); err != nil {
+			break
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		for _, q := range index {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", q.Name, q.Filename, strings.ReplaceAll(q.Description, "\n", " "))
+		}
+		err = tw.Flush()
+
+	case "show":
+		var sql string
+		if _, sql, err = queries.load(fs.Arg(0)); err == nil {
+			_, err = fmt.Fprintln(stdout, strings.TrimRight(sql, "\n"))
+		}
+
+	case "add":
+		var sql []byte
+		if *file == "" {
+			sql, err = io.ReadAll(os.Stdin)
+		} else {
+			sql, err = os.ReadFile(*file)
+		}
+		if err != nil {
+			break
+		}
+		if strings.TrimSpace(string(sql)) == "" {
+			return fail("no SQL to save")
+		}
+		var q savedQuery
+		q, err = queries.save(fs.Arg(0), *description, string(sql))
+		auditQueryChange(nil, auditQuerySave, fs.Arg(0), string(sql), nil, err)
+		if err == nil {
+			fmt.Fprintf(stderr, "saved %s as %s\n", q.Name, q.Filename)
+		}
+
+	case "rm":
+		err = queries.remove(fs.Arg(0))
+		auditQueryChange(nil, auditQueryRemove, fs.Arg(0), "", nil, err)
+
+	case "mv":
+		err = queries.rename(fs.Arg(0), fs.Arg(1))
+		auditQueryChange(nil, auditQueryRename, fs.Arg(0), "", map[string]string{"newName": fs.Arg(1)}, err)
+
+	case "export":
+		err = exportQueries(stdout, *output)
+
+	case "import":
+		err = importQueries(fs.Arg(0), *replace, stderr)
+
+	case "check":
+		var p queryStoreProblems
+		if p, err = queries.check(*repair); *repair {
+			auditQueryChange(nil, auditQueryRepair, "", "", map[string]string{
+				"missing":    strconv.Itoa(len(p.Missing)),
+				"orphans":    strconv.Itoa(len(p.Orphans)),
+				"duplicates": strconv.Itoa(len(p.Duplicates)),
+			}, err)
+		}
+		if err != nil {
+			break
+		}
+		for _, q := range p.Missing {
+			fmt.Fprintf(stdout, "missing file: %s (%s)\n", q.Name, queries.sqlPath(q.Filename))
+		}
+		for _, f := range p.Orphans {
+			fmt.Fprintf(stdout, "not indexed: %s\n", queries.sqlPath(f))
+		}
+		for _, name := range p.Duplicates {
+			fmt.Fprintf(stdout, "duplicate name: %s\n", name)
+		}
+		switch {
+		case p.empty():
+			fmt.Fprintln(stdout, "ok")
+		case *repair:
+			fmt.Fprintln(stdout, "repaired")
+		default:
+			fmt.Fprintln(stdout, "run with -repair to fix")
+			return exitUsage
+		}
+	}
+
+	if err != nil {
+		return fail("%v", err)
+	}
+	return exitOk
+}
+
+// exportQueries writes every saved query with its SQL as one JSON bundle.
+func exportQueries(stdout io.Writer, path string) error {
+	index, err := queries.list()
+	if err != nil {
+		return err
+	}
+
+	bundle := make([]queryExport, 0, len(index))
+	for _, q := range index {
+		_, sql, err := queries.load(q.Name)
+		if err != nil {
+			return err
+		}
+		bundle = append(bundle, queryExport{Name: q.Name, Description: q.Description, Chart: q.Chart, Sql: sql})
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "    ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if path == "" {
+		_, err = stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// importQueries saves the queries of a bundle. Queries whose name is taken
+// are skipped unless replace is set.
+func importQueries(path string, replace bool, stderr io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var bundle []queryExport
+	if err = json.Unmarshal(data, &bundle); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	index, err := queries.list()
+	if err != nil {
+		return err
+	}
+
+	for _, q := range bundle {
+		if strings.TrimSpace(q.Name) == "" {
+			return errors.New("a query in the bundle has no name")
+		}
+		if !replace && slices.ContainsFunc(index, func(s savedQuery) bool { return s.Name == q.Name }) {
+			fmt.Fprintf(stderr, "skipped %s, the name is taken\n", q.Name)
+			continue
+		}
+
+		_, err = queries.save(q.Name, q.Description, q.Sql)
+		auditQueryChange(nil, auditQueryImport, q.Name, q.Sql, map[string]string{"bundle": path}, err)
+		if err != nil {
+			return err
+		}
+		if err = queries.setChart(q.Name, q.Chart); err != nil {
+			return err
+		}
+		fmt.Fprintf(stderr, "imported %s\n", q.Name)
+	}
+
+	return nil
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"net/http"
-	"net/url"
-	"slices"
-
+	"net/http/httptrace"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,52 +23,184 @@ type queryRequest struct {
 	Tenant   string
 	Sample   bool
 	Query    string
+	Parallel int
+	// Unlimited skips the tenant's row limit, for go-server's own queries
+	Unlimited bool
 }
 
 const hexagonUrl = "https://us1.eam.hxgnsmartcloud.com/axis/services/EWSConnector"
 
+// htmlFlushRows is how many table rows queryToHtml writes between flushes.
+const htmlFlushRows = 200
+
 func processQuery(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	r.ParseForm()
 
-	respBody, err := getRequestBody(r.Form)
-	if err != nil {
+	run := startRun(r.Form.Get("run-id"))
+	client := resultKey(w, r)
+
+	var data queryRequest
+	if err := validateQueryRequest(r, &data); err != nil {
+		run.failed(err)
 		errorResponse(w, err.Error(), 400)
 		return
 	}
 
-	start := time.Now()
-	resp, err := http.Post(hexagonUrl, "text/xml", bytes.NewBuffer([]byte(respBody)))
-	fmt.Printf("Request time: %dms\n", time.Since(start).Milliseconds())
+	statements := splitStatements(data.Query)
+	switch len(statements) {
+	case 0:
+		err := errors.New("no statements to run")
+		run.failed(err)
+		errorResponse(w, err.Error(), 400)
+		return
+	case 1:
+		data.Query = statements[0]
+	default:
+		if !guardQuery(w, r, data, []string{data.Tenant}) {
+			run.finished(0, 0)
+			return
+		}
+		processScript(w, r, data, statements, run)
+		return
+	}
 
-	defer resp.Body.Close()
+	// exports of the result on screen use the cached copy with its view
+	procType := r.Header.Get("X-Process-Type")
+	if c, ok := results.get(client, requestUser(r).Name); ok && procType != "" && c.matches(data) {
+		auditCachedExport(r, c, len(c.Result.Rows), procType, nil)
+		if err := exportResult(w, procType, c.View.apply(c.Result)); err != nil {
+			fmt.Printf("[ERROR]: Cached export error: %v\n", err)
+			run.failed(err)
+			return
+		}
+		run.finished(0, 0)
+		return
+	}
+
+	if !guardQuery(w, r, data, []string{data.Tenant}) {
+		run.finished(0, 0)
+		return
+	}
 
+	record := func(err error) {
+		entry := newHistoryEntry(historyRun, data, err)
+		entry.Rows = run.rowCount()
+		entry.DurationMs = time.Since(run.start).Milliseconds()
+		history.record(entry)
+		auditExecution(r, entry, cmp.Or(procType, "html"), map[string]string{"sample": strconv.FormatBool(data.Sample)})
+	}
+
+	resp, requestTime, err := executeQuery(r.Context(), data, run)
 	if err != nil {
-		errorResponse(w, err.Error(), 500)
+		record(err)
+		run.failed(err)
+		errorResponse(w, err.Error(), limitedCode(w, err, 500))
 		return
 	}
+	defer resp.Body.Close()
 
-	start = time.Now()
+	start := time.Now()
 
-	processFunc := queryToHtml
+	prefs := displayPrefsFrom(r)
+	var cached *resultSet
+	processFunc := func(w http.ResponseWriter, data io.Reader, run *runTracker) error {
+		rs, err := queryToHtml(w, data, run, prefs)
+		cached = rs
+		return err
+	}
 
-	switch procType := r.Header.Get("X-Process-Type"); procType {
+	switch procType {
 	case "csv":
 		processFunc = queryToCsv
 		w.Header().Set("Content-Type", "text/csv")
 		w.Header().Set("Content-Disposition", "attachment; filename=data.csv")
 	case "xlsx":
 		processFunc = queryToXlsx
-		w.Header().Set("Content-Type", "application/application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Type", xlsxContentType)
 		w.Header().Set("Content-Disposition", "attachment; filename=data.xlsx")
+	case "json":
+		processFunc = queryToJson
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=data.json")
 	}
 
-	processFunc(w, resp.Body)
-	fmt.Printf("Parse Time: %dms\n", time.Since(start).Milliseconds())
+	err = processFunc(w, resp.Body, run)
+	parseTime := time.Since(start)
+	fmt.Printf("Parse Time: %dms\n", parseTime.Milliseconds())
+
+	record(err)
+	if err != nil {
+		run.failed(err)
+		return
+	}
+	if cached != nil {
+		results.put(client, cachedResult{Owner: requestUser(r).Name, Query: data.Query, Tenant: data.Tenant, Username: data.Username, Sample: data.Sample, Ran: run.start, Result: cached})
+	}
+	run.finished(requestTime, parseTime)
 }
 
-func queryToHtml(w http.ResponseWriter, data io.Reader) {
+// executeQuery posts the MP0170 request for data to EAM and returns the raw
+// response along with how long EAM took to answer. The caller closes the body.
+func executeQuery(ctx context.Context, data queryRequest, run *runTracker) (*http.Response, time.Duration, error) {
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			run.publish(runEvent{Type: runEventSent})
+		},
+		GotFirstResponseByte: func() {
+			run.publish(runEvent{Type: runEventFirstByte})
+		},
+	}
+
+	release, err := eamLimits.acquire(ctx, data.Tenant, limitUser(ctx, data), run)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, requestTime, err := sendQuery(httptrace.WithClientTrace(ctx, trace), data)
+	fmt.Printf("Request time: %dms\n", requestTime.Milliseconds())
+	if err != nil {
+		release()
+		return resp, requestTime, err
+	}
+
+	resp.Body = &limitedBody{resp.Body, release}
+	return resp, requestTime, nil
+}
+
+// runResultSet executes a query and parses the whole response into memory.
+func runResultSet(ctx context.Context, data queryRequest, run *runTracker) (*resultSet, error) {
+	resp, _, err := executeQuery(ctx, data, run)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return parseResultSet(resp.Body, run)
+}
+
+// queryToHtml streams the result as a table and also returns it parsed for the
+// result cache, unless it has more rows than the cache takes.
+func queryToHtml(w http.ResponseWriter, data io.Reader, run *runTracker, prefs displayPrefs) (*resultSet, error) {
 	d := xml.NewDecoder(data)
+	rows := 0
+
+	rs := &resultSet{}
+	var row []string
+	keep := true
+	// once flushed the status is sent, errors can only end the body
+	flushed := false
+
+	toolbar, err := template.ParseFiles("views/result_toolbar.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	// set up front so compression middleware sees a compressible type before
+	// the first flush commits the headers
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
 	for {
 		tok, err := d.RawToken()
 		if tok == nil && err == nil {
@@ -73,8 +209,8 @@ func queryToHtml(w http.ResponseWriter, data io.Reader) {
 			break
 		} else if err != nil {
 			fmt.Printf("Error: %v\n", err)
-			errorResponse(w, err.Error(), 500)
-			return
+			streamError(w, err.Error(), 500, flushed)
+			return nil, err
 		}
 
 		switch ty := tok.(type) {
@@ -83,40 +219,85 @@ func queryToHtml(w http.ResponseWriter, data io.Reader) {
 			case "C":
 				ctok, err := d.RawToken()
 
-				w.Write([]byte("<td>"))
+				value := ""
 				if cdata, ok := ctok.(xml.CharData); ok && err == nil {
-					w.Write(cdata)
+					value = string(cdata)
 					d.RawToken()
 				}
+
+				cell := prefs.format(rs.meta(len(row)), value)
+				row = append(row, value)
+				if cell.Numeric {
+					w.Write([]byte(`<td data-type="number">`))
+				} else {
+					w.Write([]byte("<td>"))
+				}
+				template.HTMLEscape(w, []byte(cell.Text))
 				w.Write([]byte("</td>"))
 			case "Column":
-				i := slices.IndexFunc(ty.Attr, func(attr xml.Attr) bool { return attr.Name.Local == "label" })
-				w.Write([]byte("<th><span>" + ty.Attr[i].Value + "</span></th>"))
+				meta := newColumnMeta(ty.Attr)
+				fmt.Fprintf(w, `<th class="cursor-pointer" hx-post="/result/view" hx-vals='{"sort": "%d"}' hx-target="#data"`, len(rs.Meta))
+				if meta.Numeric() {
+					w.Write([]byte(` data-type="number"`))
+				}
+				w.Write([]byte("><span>"))
+				rs.Columns = append(rs.Columns, meta.Label)
+				rs.Meta = append(rs.Meta, meta)
+				template.HTMLEscape(w, []byte(meta.Label))
+				w.Write([]byte("</span></th>"))
 			case "R":
+				run.rowParsed()
+				row = make([]string, 0, len(rs.Meta))
 				w.Write([]byte("<tr>"))
 			case "Metadata":
+				if err := toolbar.Execute(w, nil); err != nil {
+					fmt.Printf("[ERROR]: Result toolbar template execution error: %v\n", err)
+				}
 				w.Write([]byte("<table class=\"data-table\"><thead><tr>"))
 			case "Data":
 				w.Write([]byte("</thead><tbody>"))
+				flushResponse(w)
+				flushed = true
 			case "faultstring":
 				ftok, _ := d.RawToken()
-				errorResponse(w, string(ftok.(xml.CharData)), 400)
+				fault := string(ftok.(xml.CharData))
+				streamError(w, fault, 400, flushed)
+				return nil, &eamFault{Message: fault}
 			}
 		case xml.EndElement:
 			switch ty.Name.Local {
-			case "R", "Metadata":
+			case "R":
+				w.Write([]byte("</tr>"))
+				if keep && config.ResultCache.MaxRows > 0 && len(rs.Rows) >= config.ResultCache.MaxRows {
+					keep, rs.Rows = false, nil
+				}
+				if keep {
+					rs.Rows = append(rs.Rows, row)
+				}
+				if rows++; rows%htmlFlushRows == 0 {
+					flushResponse(w)
+				}
+			case "Metadata":
 				w.Write([]byte("</tr>"))
 			case "Data":
 				w.Write([]byte("</tbody></table>"))
 			}
 		}
 	}
+
+	if !keep {
+		return nil, nil
+	}
+	return rs, nil
 }
 
-func queryToCsv(w http.ResponseWriter, data io.Reader) {
+// queryToCsv streams the result as CSV, quoted the way writeResultCsv quotes
+// the cached result.
+func queryToCsv(w http.ResponseWriter, data io.Reader, run *runTracker) error {
 	d := xml.NewDecoder(data)
-	newRow := true
+	cw := csv.NewWriter(w)
 
+	var header, row []string
 	for {
 		tok, err := d.RawToken()
 		if tok == nil && err == nil {
@@ -126,7 +307,7 @@ func queryToCsv(w http.ResponseWriter, data io.Reader) {
 		} else if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			errorResponse(w, err.Error(), 500)
-			return
+			return err
 		}
 
 		switch ty := tok.(type) {
@@ -135,103 +316,104 @@ func queryToCsv(w http.ResponseWriter, data io.Reader) {
 			case "C":
 				ctok, err := d.RawToken()
 
-				if !newRow {
-					w.Write([]byte(","))
-				}
-
+				value := ""
 				if cdata, ok := ctok.(xml.CharData); ok && err == nil {
-					w.Write(cdata)
+					value = string(cdata)
 					d.RawToken()
 				}
-				newRow = false
+				row = append(row, value)
 			case "Column":
-				i := slices.IndexFunc(ty.Attr, func(attr xml.Attr) bool { return attr.Name.Local == "label" })
-				if !newRow {
-					w.Write([]byte(","))
-				}
-				w.Write([]byte(ty.Attr[i].Value))
-				newRow = false
+				header = append(header, newColumnMeta(ty.Attr).Label)
 			case "R":
-				w.Write([]byte("\n"))
-				newRow = true
+				run.rowParsed()
+				row = row[:0]
 			case "faultstring":
 				ftok, _ := d.RawToken()
-				errorResponse(w, string(ftok.(xml.CharData)), 400)
+				fault := string(ftok.(xml.CharData))
+				errorResponse(w, fault, 400)
+				return &eamFault{Message: fault}
+			}
+		case xml.EndElement:
+			switch ty.Name.Local {
+			case "Metadata":
+				err = cw.Write(header)
+			case "R":
+				err = cw.Write(row)
+			}
+			if err != nil {
+				return err
 			}
 		}
 	}
-}
 
-func queryToXlsx(w http.ResponseWriter, data io.Reader) {
-	d := xml.NewDecoder(data)
-	newRow := true
+	cw.Flush()
+	return cw.Error()
+}
 
-	for {
-		tok, err := d.RawToken()
-		if tok == nil && err == nil {
-			continue
-		} else if tok == nil && err == io.EOF {
-			break
-		} else if err != nil {
+func queryToXlsx(w http.ResponseWriter, data io.Reader, run *runTracker) error {
+	rs, err := parseResultSet(data, run)
+	if err != nil {
+		var fault *eamFault
+		if errors.As(err, &fault) {
+			errorResponse(w, fault.Message, 400)
+		} else {
 			fmt.Printf("Error: %v\n", err)
 			errorResponse(w, err.Error(), 500)
-			return
 		}
+		return err
+	}
 
-		switch ty := tok.(type) {
-		case xml.StartElement:
-			switch ty.Name.Local {
-			case "C":
-				ctok, err := d.RawToken()
-
-				if !newRow {
-					w.Write([]byte(","))
-				}
+	return writeXlsx(w, []xlsxSheet{{Name: "data", Result: rs}})
+}
 
-				if cdata, ok := ctok.(xml.CharData); ok && err == nil {
-					w.Write(cdata)
-					d.RawToken()
-				}
-				newRow = false
-			case "Column":
-				i := slices.IndexFunc(ty.Attr, func(attr xml.Attr) bool { return attr.Name.Local == "label" })
-				if !newRow {
-					w.Write([]byte(","))
-				}
-				w.Write([]byte(ty.Attr[i].Value))
-				newRow = false
-			case "R":
-				w.Write([]byte("\n"))
-				newRow = true
-			case "faultstring":
-				ftok, _ := d.RawToken()
-				errorResponse(w, string(ftok.(xml.CharData)), 400)
-			}
+// queryToJson exports the result with its column metadata and typed values.
+func queryToJson(w http.ResponseWriter, data io.Reader, run *runTracker) error {
+	rs, err := parseResultSet(data, run)
+	if err != nil {
+		var fault *eamFault
+		if errors.As(err, &fault) {
+			errorResponse(w, fault.Message, 400)
+		} else {
+			fmt.Printf("Error: %v\n", err)
+			errorResponse(w, err.Error(), 500)
 		}
+		return err
 	}
+
+	return writeResultJson(w, rs)
 }
 
-func getRequestBody(formData url.Values) (string, error) {
-	var data queryRequest
-	if err := validateQueryRequest(formData, &data); err != nil {
-		return "", err
+// writeResultJson writes rs with typed values. Dates are written without a
+// time zone, as EAM returns them.
+func writeResultJson(w io.Writer, rs *resultSet) error {
+	out := struct {
+		Columns []columnMeta `json:"columns"`
+		Rows    [][]any      `json:"rows"`
+	}{Columns: make([]columnMeta, len(rs.Columns)), Rows: make([][]any, len(rs.Rows))}
+
+	for i := range rs.Columns {
+		out.Columns[i] = rs.meta(i)
+	}
+	for i, row := range rs.Rows {
+		out.Rows[i] = make([]any, len(row))
+		for j, v := range row {
+			value := typedValue(rs.meta(j), v)
+			if t, ok := value.(time.Time); ok {
+				value = t.Format("2006-01-02T15:04:05")
+			}
+			out.Rows[i][j] = value
+		}
 	}
 
-	query := strings.Replace(data.Query, "<", "&lt;", -1)
+	return json.NewEncoder(w).Encode(out)
+}
 
-	if data.Sample {
-		query = fmt.Sprintf("SELECT * FROM (%s) WHERE ROWNUM &lt;= 50", query)
-	}
+func getRequestBody(data queryRequest, header soapHeader) string {
+	query := strings.Replace(data.expandedSql(), "<", "&lt;", -1)
 
 	return fmt.Sprintf(`<Envelope xmlns="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
 	<Header>
-		<Security xmlns="http://schemas.xmlsoap.org/ws/2002/04/secext">
-			<UsernameToken>
-				<Username>%s@%s</Username>
-				<Password>%s</Password>
-			</UsernameToken>
-		</Security>
-		<SessionScenario xmlns="http://schemas.datastream.net/headers">terminate</SessionScenario>
+		%s
 		<Organization xmlns="http://schemas.datastream.net/headers">GSO</Organization>
 	</Header>
 	<Body>
@@ -241,10 +423,13 @@ func getRequestBody(formData url.Values) (string, error) {
 			</SelectStatement>
 		</MP0170_GetDatabaseData_001>
 	</Body>
-</Envelope>`, data.Username, data.Tenant, data.Password, query), nil
+</Envelope>`, header.xml(data), query)
 }
 
-func validateQueryRequest(values url.Values, qr *queryRequest) error {
+// validateQueryRequest reads a query request from the parsed form of r, run
+// as the EAM user of the browser's session.
+func validateQueryRequest(r *http.Request, qr *queryRequest) error {
+	values := r.Form
 	var errs []string
 
 	for k, v := range values {
@@ -257,11 +442,22 @@ func validateQueryRequest(values url.Values, qr *queryRequest) error {
 		return fmt.Errorf("missing request values: [%s]", strings.Join(errs, ", "))
 	}
 
-	qr.Username = values.Get("username")
-	qr.Password = values.Get("password")
+	if _, ok := config.tenant(values.Get("tenant")); !ok {
+		return fmt.Errorf("unknown tenant %q", values.Get("tenant"))
+	}
+
+	creds, err := sessionCredentials(r)
+	if err != nil {
+		return err
+	}
+
+	qr.Username = creds.Username
+	qr.Password = creds.Password
 	qr.Tenant = values.Get("tenant")
 	qr.Sample = values.Get("sample") == "true"
 	qr.Query = values.Get("query")
+	qr.Parallel, _ = strconv.Atoi(values.Get("parallel"))
+	qr.Parallel = min(max(qr.Parallel, 1), maxScriptParallel)
 
 	return nil
 }
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// savedQuery is one entry of queries/queries.json. The SQL itself lives in
+// queries/query_files/<Filename>.sql.
+type savedQuery struct {
+	Name        string       `json:"name"`
+	Filename    string       `json:"filename"`
+	Description string       `json:"description,omitempty"`
+	Chart       *chartConfig `json:"chart,omitempty"`
+}
+
+type queryStore struct {
+	mu  sync.Mutex
+	dir string
+
+	// sqlCache keeps the SQL of each file until the file changes, as the
+	// guards and the completions read every saved query.
+	sqlMu    sync.Mutex
+	sqlCache map[string]cachedSql
+}
+
+type cachedSql struct {
+	modTime time.Time
+	size    int64
+	sql     string
+}
+
+var queries = &queryStore{dir: "queries", sqlCache: map[string]cachedSql{}}
+
+// The lock file keeps other processes, such as the queries subcommands, from
+// changing the store at the same time. Only changes take it: the index and
+// the SQL files are replaced whole, so reading never sees half a write.
+const queryLockWait = 5 * time.Second
+
+// lock takes the store for this process and, through the lock file, for any
+// other. The returned func releases it.
+func (qs *queryStore) lock() (func(), error) {
+	qs.mu.Lock()
+
+	path := filepath.Join(qs.dir, ".lock")
+	unlock, err := lockFile(path, queryLockWait)
+	if errors.Is(err, errLocked) {
+		err = errors.New("the query library is being changed by another process, try again")
+	}
+	if err != nil {
+		qs.mu.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		unlock()
+		qs.mu.Unlock()
+	}, nil
+}
+
+var errLocked = errors.New("locked by another process")
+
+func (qs *queryStore) indexPath() string {
+	return filepath.Join(qs.dir, "queries.json")
+}
+
+func (qs *queryStore) sqlPath(filename string) string {
+	return filepath.Join(qs.dir, "query_files", filename+".sql")
+}
+
+func (qs *queryStore) list() ([]savedQuery, error) {
+	return qs.readIndex()
+}
+
+func (qs *queryStore) readIndex() ([]savedQuery, error) {
+	data, err := os.ReadFile(qs.indexPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var index []savedQuery
+	if err = json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", qs.indexPath(), err)
+	}
+
+	return index, nil
+}
+
+// load returns the saved query with the given name and its SQL.
+func (qs *queryStore) load(name string) (savedQuery, string, error) {
+	index, err := qs.readIndex()
+	if err != nil {
+		return savedQuery{}, "", err
+	}
+
+	i := slices.IndexFunc(index, func(q savedQuery) bool { return q.Name == name })
+	if i < 0 {
+		return savedQuery{}, "", fmt.Errorf("no saved query named %q", name)
+	}
+
+	sql, err := qs.readSql(index[i].Filename)
+	if err != nil {
+		return savedQuery{}, "", err
+	}
+
+	return index[i], sql, nil
+}
+
+// readSql returns the SQL in the file of a saved query, from the cache as
+// long as the file is unchanged. Files are only ever replaced whole, so it
+// doesn't need the lock.
+func (qs *queryStore) readSql(filename string) (string, error) {
+	path := qs.sqlPath(filename)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	qs.sqlMu.Lock()
+	c, ok := qs.sqlCache[filename]
+	qs.sqlMu.Unlock()
+	if ok && c.modTime.Equal(info.ModTime()) && c.size == info.Size() {
+		return c.sql, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	qs.sqlMu.Lock()
+	qs.sqlCache[filename] = cachedSql{modTime: info.ModTime(), size: info.Size(), sql: string(data)}
+	qs.sqlMu.Unlock()
+
+	return string(data), nil
+}
+
+// save writes sql and its description under name, replacing the query's file
+// if the name is already taken and otherwise adding a new queryN entry to the
+// index.
+func (qs *queryStore) save(name, description, sql string) (savedQuery, error) {
+	unlock, err := qs.lock()
+	if err != nil {
+		return savedQuery{}, err
+	}
+	defer unlock()
+
+	index, err := qs.readIndex()
+	if err != nil {
+		return savedQuery{}, err
+	}
+
+	i := slices.IndexFunc(index, func(q savedQuery) bool { return q.Name == name })
+	if i < 0 {
+		index = append(index, savedQuery{Name: name, Filename: qs.nextFilename(index)})
+		i = len(index) - 1
+	}
+	index[i].Description = description
+
+	if err = writeFileAtomic(qs.sqlPath(index[i].Filename), []byte(sql)); err != nil {
+		return savedQuery{}, err
+	}
+
+	if err = qs.writeIndex(index); err != nil {
+		return savedQuery{}, err
+	}
+
+	return index[i], nil
+}
+
+// nextFilename picks the next free queryN filename, skipping files that are
+// not in the index as well.
+func (qs *queryStore) nextFilename(index []savedQuery) string {
+	used := make([]string, 0, len(index))
+	for _, q := range index {
+		used = append(used, q.Filename)
+	}
+	used = append(used, qs.files()...)
+
+	next := 1
+	for _, f := range used {
+		if n, err := strconv.Atoi(strings.TrimPrefix(f, "query")); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	return "query" + strconv.Itoa(next)
+}
+
+// files lists the filenames of the SQL files in the store.
+func (qs *queryStore) files() []string {
+	paths, _ := filepath.Glob(qs.sqlPath("*"))
+	files := make([]string, len(paths))
+	for i, p := range paths {
+		files[i] = strings.TrimSuffix(filepath.Base(p), ".sql")
+	}
+	return files
+}
+
+// writeIndex writes the index with one query per line, the way the file is
+// laid out by hand.
+func (qs *queryStore) writeIndex(index []savedQuery) error {
+	encode := func(v any) string {
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		enc.Encode(v)
+		return strings.TrimSpace(b.String())
+	}
+
+	var b bytes.Buffer
+	b.WriteString("[\n")
+	for i, q := range index {
+		fmt.Fprintf(&b, `    { "name": %s, "filename": %s`, encode(q.Name), encode(q.Filename))
+		if q.Description != "" {
+			fmt.Fprintf(&b, `, "description": %s`, encode(q.Description))
+		}
+		if q.Chart != nil {
+			fmt.Fprintf(&b, `, "chart": %s`, encode(q.Chart))
+		}
+		b.WriteString(" }")
+		if i < len(index)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("]\n")
+
+	return writeFileAtomic(qs.indexPath(), b.Bytes())
+}
+
+// writeFileAtomic replaces the file at path by writing a temporary file next
+// to it and renaming it into place.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// setChart saves the chart configuration of a saved query, or removes it
+// when chart is nil.
+func (qs *queryStore) setChart(name string, chart *chartConfig) error {
+	unlock, err := qs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := qs.readIndex()
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(index, func(q savedQuery) bool { return q.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no saved query named %q", name)
+	}
+	index[i].Chart = chart
+
+	return qs.writeIndex(index)
+}
+
+// remove deletes a saved query and its file.
+func (qs *queryStore) remove(name string) error {
+	unlock, err := qs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := qs.readIndex()
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(index, func(q savedQuery) bool { return q.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no saved query named %q", name)
+	}
+	filename := index[i].Filename
+
+	if err = qs.writeIndex(slices.Delete(index, i, i+1)); err != nil {
+		return err
+	}
+	if err = os.Remove(qs.sqlPath(filename)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// rename gives a saved query a new name. Its file stays the same.
+func (qs *queryStore) rename(name, newName string) error {
+	unlock, err := qs.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := qs.readIndex()
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(index, func(q savedQuery) bool { return q.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no saved query named %q", name)
+	}
+	if slices.ContainsFunc(index, func(q savedQuery) bool { return q.Name == newName }) {
+		return fmt.Errorf("a saved query named %q already exists", newName)
+	}
+	index[i].Name = newName
+
+	return qs.writeIndex(index)
+}
+
+// queryStoreProblems are the ways the index and the files disagree.
+type queryStoreProblems struct {
+	// Missing are index entries without a file.
+	Missing []savedQuery
+	// Orphans are files no index entry refers to.
+	Orphans []string
+	// Duplicates are names that appear more than once in the index.
+	Duplicates []string
+}
+
+func (p queryStoreProblems) empty() bool {
+	return len(p.Missing) == 0 && len(p.Orphans) == 0 && len(p.Duplicates) == 0
+}
+
+// check compares the index with the files. With repair set, entries without a
+// file are dropped, orphan files are added under their filename and repeated
+// names get a number.
+func (qs *queryStore) check(repair bool) (queryStoreProblems, error) {
+	if repair {
+		unlock, err := qs.lock()
+		if err != nil {
+			return queryStoreProblems{}, err
+		}
+		defer unlock()
+	}
+
+	index, err := qs.readIndex()
+	if err != nil {
+		return queryStoreProblems{}, err
+	}
+
+	var p queryStoreProblems
+	var kept []savedQuery
+	names := map[string]bool{}
+	for _, q := range index {
+		if _, err := os.Stat(qs.sqlPath(q.Filename)); err != nil {
+			p.Missing = append(p.Missing, q)
+			continue
+		}
+		if names[q.Name] {
+			p.Duplicates = append(p.Duplicates, q.Name)
+			name := q.Name
+			for n := 2; names[name]; n++ {
+				name = fmt.Sprintf("%s (%d)", q.Name, n)
+			}
+			q.Name = name
+		}
+		names[q.Name] = true
+		kept = append(kept, q)
+	}
+
+	for _, f := range qs.files() {
+		if !slices.ContainsFunc(index, func(q savedQuery) bool { return q.Filename == f }) {
+			p.Orphans = append(p.Orphans, f)
+
+			name := f
+			for n := 2; names[name]; n++ {
+				name = fmt.Sprintf("%s (%d)", f, n)
+			}
+			names[name] = true
+			kept = append(kept, savedQuery{Name: name, Filename: f})
+		}
+	}
+
+	if repair && !p.empty() {
+		return p, qs.writeIndex(kept)
+	}
+	return p, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// report is a standalone write-up of the cached result, for mailing around.
+type report struct {
+	Name        string
+	Description string
+	Tenant      string
+	Params      []reportParam
+	Ran         string
+	Rows        int
+	Sql         string
+	// Summary is set when Result is a summary rather than the rows.
+	Summary bool
+	Result  *resultSet
+	Cells   [][]displayCell
+	Chart   template.HTML
+}
+
+type reportParam struct {
+	Name  string
+	Value string
+}
+
+// newReport describes the cached result c as currently viewed, or the summary
+// in form when it has one. name is the saved query in the editor, if any; its
+// name, description and chart are included only when c ran its SQL, as the
+// editor may have changed since.
+func newReport(c cachedResult, name string, form map[string][]string, prefs displayPrefs) (report, error) {
+	rep := report{
+		Name:   "Unsaved query",
+		Tenant: c.Tenant,
+		Ran:    c.Ran.Format(time.DateTime + " MST"),
+		Sql:    c.Query,
+	}
+
+	sample := "all rows"
+	if c.Sample {
+		sample = "first 50 rows"
+	}
+	rep.Params = []reportParam{{"Tenant", c.Tenant}, {"Sample", sample}}
+
+	saved, sql, err := queries.load(name)
+	if err == nil && ranSql(c.Query, sql) {
+		rep.Name, rep.Description = saved.Name, saved.Description
+	} else {
+		saved = savedQuery{}
+	}
+
+	if len(form["group"]) > 0 || len(form["agg"]) > 0 {
+		view := c.View
+		view.Hidden = nil
+		rs := view.apply(c.Result)
+
+		spec, err := parseSummarySpec(form, rs)
+		if err != nil {
+			return rep, err
+		}
+		rep.Result, rep.Summary = summarize(rs, spec), true
+		rep.Rows = len(rs.Rows)
+	} else {
+		rep.Result = c.View.apply(c.Result)
+		rep.Rows = len(rep.Result.Rows)
+
+		if saved.Chart != nil {
+			if svg, err := renderChart(rep.Result, *saved.Chart); err == nil {
+				rep.Chart = template.HTML(svg)
+			}
+		}
+	}
+	rep.Cells = prefs.cells(rep.Result)
+
+	return rep, nil
+}
+
+// ranSql reports whether query, the one statement a result ran, is the SQL
+// of a saved query, ignoring layout.
+func ranSql(query, sql string) bool {
+	statements := splitStatements(sql)
+	return len(statements) == 1 && strings.Join(strings.Fields(statements[0]), " ") == strings.Join(strings.Fields(query), " ")
+}
+
+var reportFilenameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+func (rep report) filename(ext string) string {
+	name := strings.Trim(reportFilenameUnsafe.ReplaceAllString(rep.Name, "_"), "_")
+	if name == "" {
+		name = "report"
+	}
+	return name + "." + ext
+}
+
+func writeReportHtml(w io.Writer, rep report) error {
+	tmpl, err := template.New("report.html").Funcs(template.FuncMap{
+		"numeric": func(rs *resultSet, i int) bool { return rs.meta(i).Numeric() },
+	}).ParseFiles("views/report.html")
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, rep)
+}
+
+// writeReportMarkdown writes rep as GitHub-flavoured Markdown.
+func writeReportMarkdown(w io.Writer, rep report) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", markdownEscape(rep.Name))
+	if rep.Description != "" {
+		fmt.Fprintf(&b, "%s\n\n", rep.Description)
+	}
+
+	for _, p := range rep.Params {
+		fmt.Fprintf(&b, "- **%s:** %s\n", p.Name, markdownEscape(p.Value))
+	}
+	fmt.Fprintf(&b, "- **Run:** %s\n", rep.Ran)
+	fmt.Fprintf(&b, "- **Rows:** %d\n\n", rep.Rows)
+
+	fence := "```"
+	for strings.Contains(rep.Sql, fence) {
+		fence += "`"
+	}
+	fmt.Fprintf(&b, "## SQL\n\n%ssql\n%s\n%s\n\n", fence, strings.TrimSpace(rep.Sql), fence)
+
+	if rep.Summary {
+		b.WriteString("## Summary\n\n")
+	} else {
+		b.WriteString("## Result\n\n")
+	}
+
+	cols := rep.Result.Columns
+	if len(cols) > 0 {
+		b.WriteString("|")
+		for _, c := range cols {
+			fmt.Fprintf(&b, " %s |", markdownCell(c))
+		}
+		b.WriteString("\n|")
+		for i := range cols {
+			if rep.Result.meta(i).Numeric() {
+				b.WriteString(" ---: |")
+			} else {
+				b.WriteString(" --- |")
+			}
+		}
+		b.WriteString("\n")
+
+		for _, row := range rep.Cells {
+			b.WriteString("|")
+			for _, cell := range row {
+				fmt.Fprintf(&b, " %s |", markdownCell(cell.Text))
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var markdownSpecial = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`, "#", `\#`, "|", `\|`)
+
+func markdownEscape(s string) string {
+	return markdownSpecial.Replace(s)
+}
+
+// markdownCell escapes s for a table cell, which must stay on one line.
+func markdownCell(s string) string {
+	return strings.Join(strings.Fields(markdownEscape(s)), " ")
+}
+
+// resultReport downloads a report of the cached result, as HTML or Markdown
+// from the X-Process-Type header.
+func resultReport(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	c, ok := requestResult(w, r)
+	if !ok {
+		return
+	}
+
+	rep, err := newReport(c, r.Form.Get("query-name"), r.Form, displayPrefsFrom(r))
+	if err != nil {
+		errorResponse(w, err.Error(), 400)
+		return
+	}
+
+	procType := r.Header.Get("X-Process-Type")
+	switch procType {
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename="+rep.filename("html"))
+		err = writeReportHtml(w, rep)
+	case "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename="+rep.filename("md"))
+		err = writeReportMarkdown(w, rep)
+	default:
+		errorResponse(w, fmt.Sprintf("unknown report type %q", procType), 400)
+		return
+	}
+
+	auditCachedExport(r, c, rep.Rows, "report-"+procType, err)
+	if err != nil {
+		fmt.Printf("[ERROR]: Report error: %v\n", err)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"html/template"
 	"net/http"
 )
 
@@ -8,3 +11,23 @@ func errorResponse(w http.ResponseWriter, message string, code int) {
 	errElement := "<span style='color:#ff6868;font-weight:bold;'>" + message + "</span>"
 	http.Error(w, errElement, code)
 }
+
+// streamError reports an error in a streamed response. Until the first flush
+// it is an ordinary error response; after it the status has gone out, so the
+// message closes the table being streamed instead.
+func streamError(w http.ResponseWriter, message string, code int, flushed bool) {
+	if !flushed {
+		errorResponse(w, message, code)
+		return
+	}
+	fmt.Fprintf(w, "</tbody></table><span style='color:#ff6868;font-weight:bold;'>%s</span>", template.HTMLEscapeString(message))
+}
+
+// flushResponse pushes buffered output to the client. It goes through
+// http.ResponseController so wrapped writers (chi's Logger, Compress) are
+// unwrapped until one that can flush is found.
+func flushResponse(w http.ResponseWriter) {
+	if err := http.NewResponseController(w).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		fmt.Printf("[ERROR]: Response flush error: %v\n", err)
+	}
+}
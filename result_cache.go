@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultCacheConfig bounds the per-session cache of the last result. Results
+// with more than MaxRows rows are not cached.
+type resultCacheConfig struct {
+	Clients int `json:"clients"`
+	MaxRows int `json:"maxRows"`
+}
+
+const clientCookie = "client-id"
+
+var clientIdPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// clientId identifies the browser for server-side state such as the result
+// cache, setting a cookie the first time. It must be called before anything
+// is written to w.
+func clientId(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(clientCookie); err == nil && clientIdPattern.MatchString(c.Value) {
+		return c.Value
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     clientCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return id
+}
+
+// resultKey is what the request's cached result is kept under: the browser
+// and, when signed in, the session on it, so that each session has its own.
+func resultKey(w http.ResponseWriter, r *http.Request) string {
+	key := clientId(w, r)
+	if c, err := r.Cookie(appSessionCookie); err == nil && c.Value != "" {
+		key += ":" + c.Value
+	}
+	return key
+}
+
+// cachedResult is the last result a browser ran, with how it is currently
+// being viewed. Owner is the signed in user who ran it; no one else on the
+// browser gets it.
+type cachedResult struct {
+	Owner    string
+	Query    string
+	Tenant   string
+	Username string
+	Sample   bool
+	Ran      time.Time
+	Result   *resultSet
+	View     resultView
+	used     time.Time
+}
+
+// matches reports whether the cached result is the output of data, run with
+// the same EAM login.
+func (c *cachedResult) matches(data queryRequest) bool {
+	return c.Query == data.Query && c.Tenant == data.Tenant && c.Sample == data.Sample && strings.EqualFold(c.Username, data.Username)
+}
+
+type resultCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedResult
+}
+
+var results = &resultCache{entries: map[string]*cachedResult{}}
+
+// get returns a copy of the client's cached result, if owner ran it.
+func (rc *resultCache) get(client, owner string) (cachedResult, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	c, ok := rc.entries[client]
+	if !ok || !strings.EqualFold(c.Owner, owner) {
+		return cachedResult{}, false
+	}
+	c.used = time.Now()
+	return *c, true
+}
+
+// put stores the client's result, evicting the least recently used clients
+// beyond the configured limit.
+func (rc *resultCache) put(client string, c cachedResult) {
+	if c.Result == nil || (config.ResultCache.MaxRows > 0 && len(c.Result.Rows) > config.ResultCache.MaxRows) {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	c.used = time.Now()
+	rc.entries[client] = &c
+
+	for len(rc.entries) > max(config.ResultCache.Clients, 1) {
+		oldest := ""
+		for id, e := range rc.entries {
+			if oldest == "" || e.used.Before(rc.entries[oldest].used) {
+				oldest = id
+			}
+		}
+		delete(rc.entries, oldest)
+	}
+}
+
+// setView replaces the view of the client's cached result, if owner ran it.
+func (rc *resultCache) setView(client, owner string, view resultView) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if c, ok := rc.entries[client]; ok && strings.EqualFold(c.Owner, owner) {
+		c.View = view
+	}
+}
+
+// remove drops the client's cached result.
+func (rc *resultCache) remove(client string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	delete(rc.entries, client)
+}
+
+// requestResult returns the cached result of the request's browser and user.
+// It writes an error instead when there is none, or when the user may not
+// run its query (any more).
+func requestResult(w http.ResponseWriter, r *http.Request) (cachedResult, bool) {
+	u := requestUser(r)
+	c, ok := results.get(resultKey(w, r), u.Name)
+	if !ok {
+		errorResponse(w, errResultNotCached.Error(), 404)
+		return cachedResult{}, false
+	}
+	if err := checkQueryAccess(u, c.Query, []string{c.Tenant}); err != nil {
+		errorResponse(w, err.Error(), http.StatusForbidden)
+		return cachedResult{}, false
+	}
+	return c, true
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	rowAdded   = "added"
+	rowRemoved = "removed"
+	rowChanged = "changed"
+)
+
+// rowDiff is one row that differs between two result sets. Base is nil for
+// added rows and Other is nil for removed rows. Changed flags the differing
+// cells of a changed row.
+type rowDiff struct {
+	Key     string
+	Change  string
+	Base    []string
+	Other   []string
+	Changed []bool
+}
+
+// Cells returns the values to display for the row, preferring the newer side.
+func (rd rowDiff) Cells() []string {
+	if rd.Other != nil {
+		return rd.Other
+	}
+	return rd.Base
+}
+
+// CellChanged reports whether cell c differs between the two sides.
+func (rd rowDiff) CellChanged(c int) bool {
+	return rd.Changed != nil && rd.Changed[c]
+}
+
+// BaseCell returns the old value of cell c.
+func (rd rowDiff) BaseCell(c int) string {
+	if rd.Base == nil {
+		return ""
+	}
+	return rd.Base[c]
+}
+
+type resultDiff struct {
+	BaseLabel  string
+	OtherLabel string
+	Columns    []string
+	Keys       []string
+	Rows       []rowDiff
+	Unchanged  int
+}
+
+func (rd *resultDiff) Count(change string) int {
+	n := 0
+	for _, row := range rd.Rows {
+		if row.Change == change {
+			n++
+		}
+	}
+	return n
+}
+
+// diffColumn is the nth column named name in a result, so that repeated
+// names, common with joins, are told apart.
+type diffColumn struct {
+	name string
+	nth  int
+}
+
+// diffColumns numbers the repeats among names.
+func diffColumns(names []string) []diffColumn {
+	columns := make([]diffColumn, len(names))
+	seen := map[string]int{}
+	for i, name := range names {
+		columns[i] = diffColumn{name, seen[name]}
+		seen[name]++
+	}
+	return columns
+}
+
+// diffResultSets aligns the rows of two result sets on the key columns and
+// reports the rows that were added, removed or changed going from base to
+// other. Columns are matched by name, the nth of a repeated name to the nth;
+// a column only present on one side reads as blank on the other. Duplicate
+// keys are matched in order of appearance.
+func diffResultSets(base, other *resultSet, keys []string) (*resultDiff, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no key column given")
+	}
+
+	columns := diffColumns(base.Columns)
+	for _, col := range diffColumns(other.Columns) {
+		if !slices.Contains(columns, col) {
+			columns = append(columns, col)
+		}
+	}
+
+	for _, key := range keys {
+		if base.column(key) < 0 || other.column(key) < 0 {
+			return nil, fmt.Errorf("key column %q is not in both results", key)
+		}
+	}
+
+	baseRows := alignRows(base, columns)
+	otherRows := alignRows(other, columns)
+	keyIdx := make([]int, len(keys))
+	for i, key := range keys {
+		keyIdx[i] = slices.Index(columns, diffColumn{key, 0})
+	}
+
+	baseKeys, baseIds := rowKeys(baseRows, keyIdx)
+	otherKeys, otherIds := rowKeys(otherRows, keyIdx)
+
+	otherById := make(map[string]int, len(otherRows))
+	for i, id := range otherIds {
+		otherById[id] = i
+	}
+
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.name
+	}
+	diff := &resultDiff{Columns: names, Keys: keys}
+	matched := make([]bool, len(otherRows))
+
+	for i, key := range baseKeys {
+		j, ok := otherById[baseIds[i]]
+		if !ok {
+			diff.Rows = append(diff.Rows, rowDiff{Key: key, Change: rowRemoved, Base: baseRows[i]})
+			continue
+		}
+		matched[j] = true
+
+		changed := make([]bool, len(columns))
+		anyChanged := false
+		for c := range columns {
+			if baseRows[i][c] != otherRows[j][c] {
+				changed[c] = true
+				anyChanged = true
+			}
+		}
+
+		if !anyChanged {
+			diff.Unchanged++
+			continue
+		}
+		diff.Rows = append(diff.Rows, rowDiff{Key: key, Change: rowChanged, Base: baseRows[i], Other: otherRows[j], Changed: changed})
+	}
+
+	for j, key := range otherKeys {
+		if !matched[j] {
+			diff.Rows = append(diff.Rows, rowDiff{Key: key, Change: rowAdded, Other: otherRows[j]})
+		}
+	}
+
+	return diff, nil
+}
+
+// alignRows reorders every row of rs to match columns.
+func alignRows(rs *resultSet, columns []diffColumn) [][]string {
+	own := diffColumns(rs.Columns)
+	idx := make([]int, len(columns))
+	for i, col := range columns {
+		idx[i] = slices.Index(own, col)
+	}
+
+	rows := make([][]string, len(rs.Rows))
+	for r, src := range rs.Rows {
+		row := make([]string, len(columns))
+		for i, j := range idx {
+			if j >= 0 && j < len(src) {
+				row[i] = src[j]
+			}
+		}
+		rows[r] = row
+	}
+
+	return rows
+}
+
+// rowKeys builds the key of every row, to display, and an id that pairs rows
+// up. Repeated keys get an occurrence number so they still pair up one to
+// one. The ids encode the key values unambiguously, whatever they contain.
+func rowKeys(rows [][]string, keyIdx []int) (keys, ids []string) {
+	keys = make([]string, len(rows))
+	ids = make([]string, len(rows))
+	seen := map[string]int{}
+
+	for r, row := range rows {
+		parts := make([]string, len(keyIdx))
+		for i, c := range keyIdx {
+			parts[i] = row[c]
+		}
+
+		encoded, _ := json.Marshal(parts)
+		seen[string(encoded)]++
+		n := seen[string(encoded)]
+
+		keys[r] = strings.Join(parts, " | ")
+		if n > 1 {
+			keys[r] = fmt.Sprintf("%s #%d", keys[r], n)
+		}
+		ids[r] = fmt.Sprintf("%s#%d", encoded, n)
+	}
+
+	return keys, ids
+}
+
+// parseKeyColumns splits a comma separated list of key column names.
+func parseKeyColumns(value string) []string {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// resultSet is a fully parsed MP0170 response, for the features that need the
+// whole result in memory rather than streaming it straight to the client.
+// Columns holds the column labels and Meta the full metadata of each column;
+// values are kept exactly as EAM returned them.
+type resultSet struct {
+	Columns []string     `json:"columns"`
+	Meta    []columnMeta `json:"meta,omitempty"`
+	Rows    [][]string   `json:"rows"`
+}
+
+// columnMeta is the metadata of a result column from the response's Metadata
+// element.
+type columnMeta struct {
+	Name      string `json:"name"`
+	Label     string `json:"label"`
+	Type      string `json:"type,omitempty"`
+	Precision int    `json:"precision,omitempty"`
+	Scale     int    `json:"scale,omitempty"`
+}
+
+type valueKind int
+
+const (
+	kindText valueKind = iota
+	kindNumber
+	kindDate
+	kindBool
+)
+
+func newColumnMeta(attrs []xml.Attr) columnMeta {
+	attr := func(names ...string) string {
+		for _, a := range attrs {
+			if slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, a.Name.Local) }) {
+				return a.Value
+			}
+		}
+		return ""
+	}
+
+	c := columnMeta{
+		Name:  attr("name"),
+		Label: attr("label"),
+		Type:  attr("type", "datatype"),
+	}
+	c.Precision, _ = strconv.Atoi(attr("precision", "size"))
+	c.Scale, _ = strconv.Atoi(attr("scale"))
+
+	if c.Label == "" {
+		c.Label = c.Name
+	}
+	if c.Name == "" {
+		c.Name = c.Label
+	}
+
+	return c
+}
+
+// kind classifies the column by its type, which may be a type name or a
+// JDBC type code.
+func (c columnMeta) kind() valueKind {
+	if code, err := strconv.Atoi(c.Type); err == nil {
+		switch code {
+		case 2, 3, 4, 5, 6, 7, 8, -5, -6:
+			return kindNumber
+		case 91, 92, 93:
+			return kindDate
+		case 16, -7:
+			return kindBool
+		}
+		return kindText
+	}
+
+	// the base type is the name before any size or qualifier, so that
+	// TIMESTAMP(6) WITH TIME ZONE is a date but INTERVAL DAY TO SECOND isn't
+	t := strings.ToUpper(strings.TrimSpace(c.Type))
+	if i := strings.IndexAny(t, "( "); i >= 0 {
+		t = t[:i]
+	}
+	switch {
+	case slices.Contains(boolTypes, t):
+		return kindBool
+	case slices.Contains(dateTypes, t):
+		return kindDate
+	case slices.Contains(numberTypes, t):
+		return kindNumber
+	}
+	return kindText
+}
+
+// The base types of each kind, for type names.
+var (
+	boolTypes   = []string{"BOOLEAN", "BOOL"}
+	dateTypes   = []string{"DATE", "DATETIME", "TIME", "TIMESTAMP"}
+	numberTypes = []string{
+		"NUMBER", "NUMERIC", "DECIMAL", "DEC", "INT", "INTEGER", "SMALLINT", "BIGINT", "TINYINT",
+		"FLOAT", "DOUBLE", "REAL", "BINARY_FLOAT", "BINARY_DOUBLE", "BINARY_INTEGER", "PLS_INTEGER",
+	}
+)
+
+func (c columnMeta) Numeric() bool {
+	return c.kind() == kindNumber
+}
+
+// eamFault is a SOAP fault returned by EAM, as opposed to a transport or
+// parse error.
+type eamFault struct {
+	Message string
+}
+
+func (f *eamFault) Error() string {
+	return f.Message
+}
+
+func parseResultSet(data io.Reader, run *runTracker) (*resultSet, error) {
+	d := xml.NewDecoder(data)
+	rs := &resultSet{}
+
+	var row []string
+	for {
+		tok, err := d.RawToken()
+		if tok == nil && err == nil {
+			continue
+		} else if tok == nil && err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("parsing result: %w", err)
+		}
+
+		switch ty := tok.(type) {
+		case xml.StartElement:
+			switch ty.Name.Local {
+			case "C":
+				ctok, err := d.RawToken()
+
+				value := ""
+				if cdata, ok := ctok.(xml.CharData); ok && err == nil {
+					value = string(cdata)
+					d.RawToken()
+				}
+				row = append(row, value)
+			case "Column":
+				meta := newColumnMeta(ty.Attr)
+				rs.Columns = append(rs.Columns, meta.Label)
+				rs.Meta = append(rs.Meta, meta)
+			case "R":
+				run.rowParsed()
+				row = make([]string, 0, len(rs.Columns))
+			case "faultstring":
+				ftok, _ := d.RawToken()
+				fault, _ := ftok.(xml.CharData)
+				return nil, &eamFault{Message: string(fault)}
+			}
+		case xml.EndElement:
+			if ty.Name.Local == "R" {
+				rs.Rows = append(rs.Rows, row)
+			}
+		}
+	}
+
+	return rs, nil
+}
+
+// column returns the index of the named column, or -1.
+func (rs *resultSet) column(name string) int {
+	return slices.Index(rs.Columns, name)
+}
+
+// meta returns the metadata of column i. Results saved before metadata was
+// kept only have labels.
+func (rs *resultSet) meta(i int) columnMeta {
+	if i < len(rs.Meta) {
+		return rs.Meta[i]
+	}
+	if i < len(rs.Columns) {
+		return columnMeta{Name: rs.Columns[i], Label: rs.Columns[i]}
+	}
+	return columnMeta{}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var aggregateFuncs = []string{"count", "sum", "avg", "min", "max"}
+
+// aggregateSpec is one aggregate of a summary. Column is -1 for count(*).
+type aggregateSpec struct {
+	Func   string
+	Column int
+}
+
+// summarySpec describes a summary of a result: the rows are grouped by the
+// GroupBy columns and each group gets the aggregates. With Pivot set, the
+// values of that column become columns holding the first aggregate. Date
+// columns in the grouping are truncated to Bucket, "day", "month" or "year".
+type summarySpec struct {
+	GroupBy    []int
+	Aggregates []aggregateSpec
+	Pivot      int
+	Pivoted    bool
+	Bucket     string
+}
+
+// parseSummarySpec reads a summary from the form: group and agg are repeated,
+// agg values look like "sum:3" or "count:*".
+func parseSummarySpec(form map[string][]string, rs *resultSet) (summarySpec, error) {
+	spec := summarySpec{}
+	column := func(s string) (int, error) {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 || i >= len(rs.Columns) {
+			return 0, fmt.Errorf("no column %q", s)
+		}
+		return i, nil
+	}
+
+	for _, g := range form["group"] {
+		i, err := column(g)
+		if err != nil {
+			return spec, err
+		}
+		if !slices.Contains(spec.GroupBy, i) {
+			spec.GroupBy = append(spec.GroupBy, i)
+		}
+	}
+
+	for _, a := range form["agg"] {
+		fn, col, _ := strings.Cut(a, ":")
+		if !slices.Contains(aggregateFuncs, fn) {
+			return spec, fmt.Errorf("unknown aggregate %q", fn)
+		}
+
+		agg := aggregateSpec{Func: fn, Column: -1}
+		if col != "*" {
+			i, err := column(col)
+			if err != nil {
+				return spec, err
+			}
+			agg.Column = i
+		}
+
+		switch {
+		case agg.Column < 0 && fn != "count":
+			return spec, fmt.Errorf("%s needs a column", fn)
+		case (fn == "sum" || fn == "avg") && rs.meta(agg.Column).kind() != kindNumber:
+			return spec, fmt.Errorf("%s needs a numeric column, %s is not", fn, rs.Columns[agg.Column])
+		}
+		spec.Aggregates = append(spec.Aggregates, agg)
+	}
+	if len(spec.Aggregates) == 0 {
+		spec.Aggregates = []aggregateSpec{{Func: "count", Column: -1}}
+	}
+
+	if p := firstValue(form["pivot"]); p != "" {
+		i, err := column(p)
+		if err != nil {
+			return spec, err
+		}
+		spec.Pivot, spec.Pivoted = i, true
+	}
+
+	if b := firstValue(form["bucket"]); b == "day" || b == "month" || b == "year" {
+		spec.Bucket = b
+	}
+
+	return spec, nil
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
+
+// accumulator computes one aggregate over the values added to it.
+type accumulator struct {
+	spec     aggregateSpec
+	meta     columnMeta
+	count    int
+	sum      float64
+	min, max string
+}
+
+func (a *accumulator) add(row []string) {
+	if a.spec.Column < 0 {
+		a.count++
+		return
+	}
+
+	v := row[a.spec.Column]
+	if v == "" {
+		return
+	}
+
+	switch a.spec.Func {
+	case "sum", "avg":
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return
+		}
+		a.sum += f
+	case "min":
+		if a.count == 0 || compareValues(a.meta, v, a.min) < 0 {
+			a.min = v
+		}
+	case "max":
+		if a.count == 0 || compareValues(a.meta, v, a.max) > 0 {
+			a.max = v
+		}
+	}
+	a.count++
+}
+
+func (a *accumulator) result() string {
+	switch a.spec.Func {
+	case "count":
+		return strconv.Itoa(a.count)
+	case "sum":
+		return formatAggregate(a.sum)
+	case "avg":
+		if a.count == 0 {
+			return ""
+		}
+		return formatAggregate(a.sum / float64(a.count))
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	}
+	return ""
+}
+
+// formatAggregate writes f with at most six decimals and no trailing zeros.
+func formatAggregate(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 6, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// meta is the column metadata of the aggregate's output.
+func (spec aggregateSpec) meta(rs *resultSet) columnMeta {
+	label := spec.Func + "(*)"
+	if spec.Column >= 0 {
+		label = fmt.Sprintf("%s(%s)", spec.Func, rs.Columns[spec.Column])
+	}
+
+	switch spec.Func {
+	case "min", "max":
+		m := rs.meta(spec.Column)
+		m.Name, m.Label = label, label
+		return m
+	}
+	return columnMeta{Name: label, Label: label, Type: "NUMBER"}
+}
+
+// groupKey returns the value of column i used for grouping.
+func (spec summarySpec) groupKey(rs *resultSet, row []string, i int) string {
+	v := row[i]
+	if spec.Bucket == "" || rs.meta(i).kind() != kindDate {
+		return v
+	}
+
+	t, err := parseEamDate(v)
+	if err != nil {
+		return v
+	}
+	switch spec.Bucket {
+	case "year":
+		return t.Format("2006")
+	case "month":
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// summarize computes the summary of rs as a new result, with one row per
+// group sorted by the group values.
+func summarize(rs *resultSet, spec summarySpec) *resultSet {
+	out := &resultSet{}
+	for _, g := range spec.GroupBy {
+		m := rs.meta(g)
+		if spec.Bucket != "" && m.kind() == kindDate {
+			m.Type = "VARCHAR2"
+		}
+		out.Columns = append(out.Columns, m.Label)
+		out.Meta = append(out.Meta, m)
+	}
+
+	type group struct {
+		key   []string
+		cells map[string][]*accumulator
+		total []*accumulator
+	}
+	newAccumulators := func(specs []aggregateSpec) []*accumulator {
+		accs := make([]*accumulator, len(specs))
+		for i, a := range specs {
+			accs[i] = &accumulator{spec: a}
+			if a.Column >= 0 {
+				accs[i].meta = rs.meta(a.Column)
+			}
+		}
+		return accs
+	}
+
+	aggregates := spec.Aggregates
+	if spec.Pivoted {
+		aggregates = aggregates[:1]
+	}
+
+	var (
+		groups      []*group
+		byKey       = map[string]*group{}
+		pivotValues []string
+	)
+	for _, row := range rs.Rows {
+		key := make([]string, len(spec.GroupBy))
+		for i, g := range spec.GroupBy {
+			key[i] = spec.groupKey(rs, row, g)
+		}
+
+		id := strings.Join(key, "\x00")
+		g, ok := byKey[id]
+		if !ok {
+			g = &group{key: key, cells: map[string][]*accumulator{}, total: newAccumulators(aggregates)}
+			byKey[id] = g
+			groups = append(groups, g)
+		}
+
+		for _, acc := range g.total {
+			acc.add(row)
+		}
+
+		if spec.Pivoted {
+			p := spec.groupKey(rs, row, spec.Pivot)
+			if _, ok := g.cells[p]; !ok {
+				g.cells[p] = newAccumulators(aggregates)
+			}
+			if !slices.Contains(pivotValues, p) {
+				pivotValues = append(pivotValues, p)
+			}
+			for _, acc := range g.cells[p] {
+				acc.add(row)
+			}
+		}
+	}
+
+	if spec.Pivoted {
+		pivotMeta := rs.meta(spec.Pivot)
+		slices.SortFunc(pivotValues, func(a, b string) int { return compareValues(pivotMeta, a, b) })
+
+		valueMeta := aggregates[0].meta(rs)
+		for _, p := range pivotValues {
+			m := valueMeta
+			m.Name, m.Label = p, p
+			if p == "" {
+				m.Name, m.Label = "(blank)", "(blank)"
+			}
+			out.Columns = append(out.Columns, m.Label)
+			out.Meta = append(out.Meta, m)
+		}
+		valueMeta.Name, valueMeta.Label = "Total", "Total"
+		out.Columns = append(out.Columns, "Total")
+		out.Meta = append(out.Meta, valueMeta)
+	} else {
+		for _, a := range aggregates {
+			m := a.meta(rs)
+			out.Columns = append(out.Columns, m.Label)
+			out.Meta = append(out.Meta, m)
+		}
+	}
+
+	slices.SortStableFunc(groups, func(a, b *group) int {
+		for i := range spec.GroupBy {
+			if c := compareValues(out.meta(i), a.key[i], b.key[i]); c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+
+	for _, g := range groups {
+		row := slices.Clone(g.key)
+		if spec.Pivoted {
+			for _, p := range pivotValues {
+				cell := ""
+				if accs, ok := g.cells[p]; ok {
+					cell = accs[0].result()
+				}
+				row = append(row, cell)
+			}
+		}
+		for _, acc := range g.total {
+			row = append(row, acc.result())
+		}
+		out.Rows = append(out.Rows, row)
+	}
+
+	return out
+}
+
+type summaryColumn struct {
+	Index   int
+	Label   string
+	Grouped bool
+	Pivot   bool
+	// Aggregates are the aggregates the column's type allows.
+	Aggregates []summaryChoice
+}
+
+type summaryChoice struct {
+	Func    string
+	Value   string
+	Checked bool
+}
+
+type summaryPage struct {
+	Columns  []summaryColumn
+	CountAll bool
+	Bucket   string
+	Summary  *resultSet
+	Rows     [][]displayCell
+}
+
+// resultSummary computes a summary of the cached result as currently
+// filtered. With an X-Process-Type header it is exported instead of shown.
+func resultSummary(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	c, ok := requestResult(w, r)
+	if !ok {
+		return
+	}
+
+	view := c.View
+	view.Hidden = nil
+	rs := view.apply(c.Result)
+
+	checked := func(value string) bool { return slices.Contains(r.Form["agg"], value) }
+	page := summaryPage{CountAll: checked("count:*"), Bucket: firstValue(r.Form["bucket"])}
+	for i, label := range rs.Columns {
+		col := summaryColumn{
+			Index:   i,
+			Label:   label,
+			Grouped: slices.Contains(r.Form["group"], strconv.Itoa(i)),
+			Pivot:   firstValue(r.Form["pivot"]) == strconv.Itoa(i),
+		}
+
+		kind := rs.meta(i).kind()
+		for _, fn := range aggregateFuncs {
+			switch {
+			case (fn == "sum" || fn == "avg") && kind != kindNumber:
+				continue
+			case (fn == "min" || fn == "max") && kind != kindNumber && kind != kindDate:
+				continue
+			}
+			value := fn + ":" + strconv.Itoa(i)
+			col.Aggregates = append(col.Aggregates, summaryChoice{Func: fn, Value: value, Checked: checked(value)})
+		}
+
+		page.Columns = append(page.Columns, col)
+	}
+
+	if r.Method == http.MethodPost {
+		spec, err := parseSummarySpec(r.Form, rs)
+		if err != nil {
+			errorResponse(w, err.Error(), 400)
+			return
+		}
+		page.Summary = summarize(rs, spec)
+
+		if procType := r.Header.Get("X-Process-Type"); procType != "" {
+			err = exportResult(w, procType, page.Summary)
+			auditCachedExport(r, c, len(page.Summary.Rows), "summary-"+procType, err)
+			if err != nil {
+				fmt.Printf("[ERROR]: Summary export error: %v\n", err)
+			}
+			return
+		}
+		page.Rows = displayPrefsFrom(r).cells(page.Summary)
+	}
+
+	tmpl, err := template.ParseFiles("views/result_summary.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tmpl.Execute(w, page); err != nil {
+		fmt.Printf("[ERROR]: Summary template execution error: %v\n", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// resultView is how a cached result is shown: optionally sorted by one
+// column, filtered per column and with some columns hidden. Columns are
+// referred to by index.
+type resultView struct {
+	Sorted  bool
+	Sort    int
+	Desc    bool
+	Filters map[int]columnFilter
+	Hidden  map[int]bool
+}
+
+// columnFilter keeps the rows whose value contains Text and lies between Min
+// and Max, compared as the column's type. Empty fields don't filter.
+type columnFilter struct {
+	Text string
+	Min  string
+	Max  string
+}
+
+func (f columnFilter) keep(c columnMeta, value string) bool {
+	switch {
+	case f.Text != "" && !strings.Contains(strings.ToLower(value), strings.ToLower(f.Text)):
+		return false
+	case f.Min != "" && (value == "" || compareValues(c, value, f.Min) < 0):
+		return false
+	case f.Max != "" && (value == "" || compareValues(c, value, f.Max) > 0):
+		return false
+	}
+	return true
+}
+
+// compareValues orders two raw values of column c by its type. Values that
+// don't parse compare as text.
+func compareValues(c columnMeta, a, b string) int {
+	switch c.kind() {
+	case kindNumber:
+		x, errA := strconv.ParseFloat(a, 64)
+		y, errB := strconv.ParseFloat(b, 64)
+		if errA == nil && errB == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	case kindDate:
+		x, errA := parseEamDate(a)
+		y, errB := parseEamDate(b)
+		if errA == nil && errB == nil {
+			return x.Compare(y)
+		}
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// apply returns the rows of rs that pass the filters, in view order, with
+// only the visible columns.
+func (v resultView) apply(rs *resultSet) *resultSet {
+	var rows [][]string
+	for _, row := range rs.Rows {
+		keep := true
+		for i, f := range v.Filters {
+			if i < len(row) && !f.keep(rs.meta(i), row[i]) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			rows = append(rows, row)
+		}
+	}
+
+	if v.Sorted && v.Sort < len(rs.Columns) {
+		meta := rs.meta(v.Sort)
+		slices.SortStableFunc(rows, func(a, b []string) int {
+			x, y := a[v.Sort], b[v.Sort]
+			// empty values go last either way
+			switch {
+			case x == "" && y == "":
+				return 0
+			case x == "":
+				return 1
+			case y == "":
+				return -1
+			}
+			if v.Desc {
+				return compareValues(meta, y, x)
+			}
+			return compareValues(meta, x, y)
+		})
+	}
+
+	out := &resultSet{}
+	var visible []int
+	for i, label := range rs.Columns {
+		if !v.Hidden[i] {
+			visible = append(visible, i)
+			out.Columns = append(out.Columns, label)
+			out.Meta = append(out.Meta, rs.meta(i))
+		}
+	}
+
+	out.Rows = make([][]string, len(rows))
+	for r, row := range rows {
+		out.Rows[r] = make([]string, len(visible))
+		for c, i := range visible {
+			if i < len(row) {
+				out.Rows[r][c] = row[i]
+			}
+		}
+	}
+
+	return out
+}
+
+// update changes the view from a submitted form: a sort click, a reset, or
+// the filter and column form.
+func (v resultView) update(form map[string][]string, columns int) resultView {
+	get := func(key string) string {
+		if values := form[key]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+
+	if s := get("sort"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 || i >= columns {
+			return v
+		}
+
+		// clicking a column cycles through ascending, descending and unsorted
+		switch {
+		case !v.Sorted || v.Sort != i:
+			v.Sorted, v.Sort, v.Desc = true, i, false
+		case !v.Desc:
+			v.Desc = true
+		default:
+			v.Sorted, v.Desc = false, false
+		}
+		return v
+	}
+
+	if get("reset") != "" {
+		return resultView{}
+	}
+
+	v.Filters, v.Hidden = map[int]columnFilter{}, map[int]bool{}
+	shown := form["show"]
+	for i := 0; i < columns; i++ {
+		n := strconv.Itoa(i)
+		if f := (columnFilter{Text: get("filter-" + n), Min: get("min-" + n), Max: get("max-" + n)}); f != (columnFilter{}) {
+			v.Filters[i] = f
+		}
+		if !slices.Contains(shown, n) {
+			v.Hidden[i] = true
+		}
+	}
+
+	return v
+}
+
+type viewColumn struct {
+	Index   int
+	Label   string
+	Numeric bool
+	// Ranged columns are numbers or dates, which get min and max filters.
+	Ranged bool
+	Hidden bool
+	Filter columnFilter
+	// Sort is "asc" or "desc" for the sorted column.
+	Sort string
+}
+
+type resultViewPage struct {
+	Columns   []viewColumn
+	Visible   []viewColumn
+	Rows      [][]displayCell
+	Shown     int
+	Total     int
+	SqliteDbs []string
+}
+
+func newResultViewPage(c cachedResult, prefs displayPrefs, user string) resultViewPage {
+	rs, v := c.Result, c.View
+	viewed := v.apply(rs)
+
+	page := resultViewPage{Rows: prefs.cells(viewed), Shown: len(viewed.Rows), Total: len(rs.Rows), SqliteDbs: sqliteDatabases(user)}
+	for i, label := range rs.Columns {
+		meta := rs.meta(i)
+		col := viewColumn{
+			Index:   i,
+			Label:   label,
+			Numeric: meta.Numeric(),
+			Ranged:  meta.kind() == kindNumber || meta.kind() == kindDate,
+			Hidden:  v.Hidden[i],
+			Filter:  v.Filters[i],
+		}
+		if v.Sorted && v.Sort == i {
+			col.Sort = "asc"
+			if v.Desc {
+				col.Sort = "desc"
+			}
+		}
+
+		page.Columns = append(page.Columns, col)
+		if !col.Hidden {
+			page.Visible = append(page.Visible, col)
+		}
+	}
+
+	return page
+}
+
+var errResultNotCached = errors.New("the result is no longer cached, run the query again")
+
+// resultViewShow renders the cached result with its current view.
+func resultViewShow(w http.ResponseWriter, r *http.Request) {
+	c, ok := requestResult(w, r)
+	if !ok {
+		return
+	}
+
+	renderResultView(w, r, c)
+}
+
+// resultViewUpdate changes the view of the cached result and renders it,
+// without running the query again.
+func resultViewUpdate(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	c, ok := requestResult(w, r)
+	if !ok {
+		return
+	}
+
+	c.View = c.View.update(r.Form, len(c.Result.Columns))
+	results.setView(resultKey(w, r), c.Owner, c.View)
+
+	renderResultView(w, r, c)
+}
+
+func renderResultView(w http.ResponseWriter, r *http.Request, c cachedResult) {
+	tmpl, err := template.ParseFiles("views/result_view.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tmpl.Execute(w, newResultViewPage(c, displayPrefsFrom(r), requestUser(r).Name)); err != nil {
+		fmt.Printf("[ERROR]: Result view template execution error: %v\n", err)
+	}
+}
+
+// exportResult writes rs in an export format from the X-Process-Type header.
+func exportResult(w http.ResponseWriter, procType string, rs *resultSet) error {
+	switch procType {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=data.csv")
+		return writeResultCsv(w, rs)
+	case "xlsx":
+		w.Header().Set("Content-Type", xlsxContentType)
+		w.Header().Set("Content-Disposition", "attachment; filename=data.xlsx")
+		return writeXlsx(w, []xlsxSheet{{Name: "data", Result: rs}})
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=data.json")
+		return writeResultJson(w, rs)
+	}
+	return fmt.Errorf("unknown export type %q", procType)
+}
+
+func writeResultCsv(w io.Writer, rs *resultSet) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(rs.Columns); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(rs.Rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
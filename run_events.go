@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// runEvent is a single progress update for a query run, streamed to the
+// browser over SSE while processQuery is working.
+type runEvent struct {
+	Type      string `json:"type"`
+	Elapsed   int64  `json:"elapsed"`
+	Rows      int    `json:"rows,omitempty"`
+	RequestMs int64  `json:"requestMs,omitempty"`
+	ParseMs   int64  `json:"parseMs,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Position  int    `json:"position,omitempty"`
+}
+
+const (
+	runEventQueued    = "queued"
+	runEventSent      = "sent"
+	runEventFirstByte = "first-byte"
+	runEventRows      = "rows"
+	runEventFinished  = "finished"
+	runEventFailed    = "failed"
+
+	// rows events are throttled so large results don't flood the stream
+	runRowsInterval = 200 * time.Millisecond
+	// trackers are kept this long after a run ends so late subscribers still
+	// get the full history, and dropped this long after being created if
+	// nobody ever starts the run
+	runTrackerTTL = 2 * time.Minute
+)
+
+type runTracker struct {
+	mu       sync.Mutex
+	id       string
+	start    time.Time
+	events   []runEvent
+	subs     map[chan runEvent]struct{}
+	done     bool
+	started  bool
+	rows     int
+	lastRows time.Time
+}
+
+type runRegistry struct {
+	mu       sync.Mutex
+	trackers map[string]*runTracker
+}
+
+var runs = runRegistry{trackers: map[string]*runTracker{}}
+
+// get returns the tracker for id, creating it if needed. Either the SSE
+// subscriber or the run itself may arrive first.
+func (rr *runRegistry) get(id string) *runTracker {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if t, ok := rr.trackers[id]; ok {
+		return t
+	}
+
+	t := &runTracker{id: id, start: time.Now(), subs: map[chan runEvent]struct{}{}}
+	rr.trackers[id] = t
+	time.AfterFunc(runTrackerTTL, func() {
+		t.mu.Lock()
+		started := t.started
+		t.mu.Unlock()
+
+		if !started {
+			rr.remove(id)
+		}
+	})
+
+	return t
+}
+
+// remove drops the tracker for id and ends any streams still waiting on it.
+func (rr *runRegistry) remove(id string) {
+	rr.mu.Lock()
+	t := rr.trackers[id]
+	delete(rr.trackers, id)
+	rr.mu.Unlock()
+
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.done = true
+	for ch := range t.subs {
+		close(ch)
+	}
+	t.subs = nil
+}
+
+// startRun resets the tracker clock so elapsed times are relative to the
+// moment the run actually began. A blank id returns a tracker nobody can
+// subscribe to, which still counts rows. Every tracker method is also a
+// no-op on a nil tracker.
+func startRun(id string) *runTracker {
+	if id == "" {
+		return &runTracker{start: time.Now()}
+	}
+
+	t := runs.get(id)
+	t.mu.Lock()
+	t.start = time.Now()
+	t.started = true
+	t.mu.Unlock()
+
+	return t
+}
+
+func (t *runTracker) publish(ev runEvent) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done {
+		return
+	}
+
+	ev.Elapsed = time.Since(t.start).Milliseconds()
+	t.events = append(t.events, ev)
+	for ch := range t.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+
+	if ev.Type == runEventFinished || ev.Type == runEventFailed {
+		t.done = true
+		for ch := range t.subs {
+			close(ch)
+		}
+		t.subs = nil
+
+		if t.id != "" {
+			time.AfterFunc(runTrackerTTL, func() { runs.remove(t.id) })
+		}
+	}
+}
+
+// rowParsed counts a parsed row and publishes a rows event at most once per
+// runRowsInterval.
+func (t *runTracker) rowParsed() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.rows++
+	rows := t.rows
+	publish := time.Since(t.lastRows) >= runRowsInterval
+	if publish {
+		t.lastRows = time.Now()
+	}
+	t.mu.Unlock()
+
+	if publish {
+		t.publish(runEvent{Type: runEventRows, Rows: rows})
+	}
+}
+
+func (t *runTracker) rowCount() int {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rows
+}
+
+func (t *runTracker) finished(requestTime, parseTime time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.publish(runEvent{
+		Type:      runEventFinished,
+		Rows:      t.rowCount(),
+		RequestMs: requestTime.Milliseconds(),
+		ParseMs:   parseTime.Milliseconds(),
+	})
+}
+
+func (t *runTracker) failed(err error) {
+	t.publish(runEvent{Type: runEventFailed, Message: err.Error()})
+}
+
+// subscribe returns the events published so far and a channel for the rest.
+// The channel is nil once the run is over.
+func (t *runTracker) subscribe() ([]runEvent, chan runEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history := append([]runEvent(nil), t.events...)
+	if t.done {
+		return history, nil
+	}
+
+	ch := make(chan runEvent, 64)
+	t.subs[ch] = struct{}{}
+
+	return history, ch
+}
+
+func (t *runTracker) unsubscribe(ch chan runEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.subs[ch]; ok {
+		delete(t.subs, ch)
+		close(ch)
+	}
+}
+
+func runEvents(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	t := runs.get(id)
+	history, ch := t.subscribe()
+
+	for _, ev := range history {
+		writeRunEvent(w, ev)
+	}
+	flushResponse(w)
+
+	if ch == nil {
+		return
+	}
+	defer t.unsubscribe(ch)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeRunEvent(w, ev)
+			flushResponse(w)
+		}
+	}
+}
+
+func writeRunEvent(w http.ResponseWriter, ev runEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Printf("[ERROR]: Run event encoding error: %v\n", err)
+		return
+	}
+
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+}
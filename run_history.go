@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyEntry records one query execution. Credentials other than the
+// username are never written to the history.
+type historyEntry struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Tenant     string    `json:"tenant"`
+	Username   string    `json:"username"`
+	Query      string    `json:"query"`
+	Rows       int       `json:"rows"`
+	DurationMs int64     `json:"durationMs"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+const (
+	historyRun      = "run"
+	historyScript   = "script"
+	historyCompare  = "compare"
+	historySnapshot = "snapshot"
+)
+
+func newHistoryEntry(kind string, data queryRequest, err error) historyEntry {
+	e := historyEntry{
+		Time:     time.Now(),
+		Kind:     kind,
+		Tenant:   data.Tenant,
+		Username: data.Username,
+		Query:    data.Query,
+		Status:   runStatus(err),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	// a password must not reach the history, even echoed back in a fault
+	if data.Password != "" {
+		e.Query = strings.ReplaceAll(e.Query, data.Password, "********")
+		e.Error = strings.ReplaceAll(e.Error, data.Password, "********")
+	}
+	return e
+}
+
+// runStatus classifies the outcome of a run for the history.
+func runStatus(err error) string {
+	var fault *eamFault
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &fault):
+		return "fault"
+	default:
+		return "error"
+	}
+}
+
+// runHistory is an append-only JSONL log of executions. It also keeps a
+// count of how often each identifier appears in past queries, which is used
+// to rank editor completions.
+type runHistory struct {
+	mu     sync.Mutex
+	usage  map[string]int
+	loaded bool
+}
+
+var history = &runHistory{}
+
+func historyPath() string {
+	return filepath.Join(config.DataDir, "history.jsonl")
+}
+
+func (h *runHistory) record(e historyEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		fmt.Printf("[ERROR]: History encoding error: %v\n", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err = appendLine(historyPath(), data); err != nil {
+		fmt.Printf("[ERROR]: History write error: %v\n", err)
+		return
+	}
+
+	if h.loaded {
+		countIdentifiers(h.usage, e.Query)
+	}
+}
+
+// entries returns up to limit history entries, newest first. A limit of zero
+// returns everything.
+func (h *runHistory) entries(limit int) ([]historyEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var all []historyEntry
+	err := h.scan(func(e historyEntry) {
+		all = append(all, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(all)
+	if limit > 0 && len(all) > limit {
+		all = all[:limit]
+	}
+
+	return all, nil
+}
+
+// usageCount returns how many times word appeared in past queries.
+func (h *runHistory) usageCount(word string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.loaded {
+		h.usage = map[string]int{}
+		if err := h.scan(func(e historyEntry) { countIdentifiers(h.usage, e.Query) }); err != nil {
+			fmt.Printf("[ERROR]: History read error: %v\n", err)
+		}
+		h.loaded = true
+	}
+
+	return h.usage[strings.ToUpper(word)]
+}
+
+func (h *runHistory) scan(fn func(historyEntry)) error {
+	f, err := os.Open(historyPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var e historyEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		fn(e)
+	}
+
+	return sc.Err()
+}
+
+func countIdentifiers(usage map[string]int, query string) {
+	for _, tok := range tokenizeSql(query) {
+		if tok.Kind == sqlWord {
+			usage[strings.ToUpper(tok.Text)]++
+		}
+	}
+}
+
+// appendLine appends data and a newline to the file at path, creating the
+// file and its directory if needed.
+func appendLine(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
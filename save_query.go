@@ -1,17 +1,72 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"strings"
 )
 
+type savePopup struct {
+	Format      formatOptions
+	Name        string
+	Description string
+}
+
+// saveQuery shows the save popup, filled in from the saved query of
+// query-name when there is one.
 func saveQuery(w http.ResponseWriter, r *http.Request) {
+	popup := savePopup{Format: config.Format}
+	if q, _, err := queries.load(r.URL.Query().Get("query-name")); err == nil {
+		popup.Name, popup.Description = q.Name, q.Description
+	}
 
 	t, _ := template.ParseFiles("views/save_popup.html")
-	if err := t.Execute(w, nil); err != nil {
+	if err := t.Execute(w, popup); err != nil {
 		fmt.Printf("Error decoding element: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
+
+// submitSavedQuery saves the editor contents under query-name, formatting
+// them first when the format box is ticked. The response is the saved name,
+// and a query-saved event carries the SQL back to the editor.
+func submitSavedQuery(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	name := strings.TrimSpace(r.Form.Get("query-name"))
+	sql := r.Form.Get("query")
+	if name == "" || strings.TrimSpace(sql) == "" {
+		errorResponse(w, "a saved query needs a name and some SQL", 400)
+		return
+	}
+
+	if r.Form.Get("format") != "" {
+		// SQL the formatter would change is saved as it was written
+		if formatted, err := formatSql(sql, parseFormatOptions(r)); err == nil {
+			sql = formatted
+		} else {
+			fmt.Printf("[ERROR]: Format on save skipped for %s: %v\n", name, err)
+		}
+	}
+
+	q, err := queries.save(name, strings.TrimSpace(r.Form.Get("description")), sql)
+	auditQueryChange(r, auditQuerySave, name, sql, nil, err)
+	if err != nil {
+		fmt.Printf("[ERROR]: Query save error: %v\n", err)
+		errorResponse(w, err.Error(), 500)
+		return
+	}
+
+	trigger, err := json.Marshal(map[string]any{
+		"query-saved": map[string]string{"name": q.Name, "sql": sql},
+	})
+	if err == nil {
+		w.Header().Set("HX-Trigger", string(trigger))
+	}
+
+	template.HTMLEscape(w, []byte(q.Name))
+}
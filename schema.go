@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type schemaColumn struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Length    string `json:"length,omitempty"`
+	Precision string `json:"precision,omitempty"`
+	Scale     string `json:"scale,omitempty"`
+	Nullable  bool   `json:"nullable"`
+}
+
+// TypeLabel renders the column type the way Oracle tools do, e.g.
+// VARCHAR2(30) or NUMBER(12,2).
+func (c schemaColumn) TypeLabel() string {
+	switch {
+	case c.Precision != "" && c.Scale != "" && c.Scale != "0":
+		return fmt.Sprintf("%s(%s,%s)", c.Type, c.Precision, c.Scale)
+	case c.Precision != "":
+		return fmt.Sprintf("%s(%s)", c.Type, c.Precision)
+	case c.Length != "" && strings.Contains(c.Type, "CHAR"):
+		return fmt.Sprintf("%s(%s)", c.Type, c.Length)
+	default:
+		return c.Type
+	}
+}
+
+type schemaTable struct {
+	Owner   string         `json:"owner"`
+	Name    string         `json:"name"`
+	View    bool           `json:"view"`
+	Columns []schemaColumn `json:"columns"`
+}
+
+func (t schemaTable) QualifiedName() string {
+	return t.Owner + "." + t.Name
+}
+
+// tenantSchema is the cached data dictionary of one tenant.
+type tenantSchema struct {
+	Tenant      string        `json:"tenant"`
+	RefreshedAt time.Time     `json:"refreshedAt"`
+	Tables      []schemaTable `json:"tables"`
+}
+
+// table looks a table or view up by name, with or without its owner.
+func (s *tenantSchema) table(name string) (schemaTable, bool) {
+	name = strings.ToUpper(name)
+	for _, t := range s.Tables {
+		if t.Name == name || t.QualifiedName() == name {
+			return t, true
+		}
+	}
+	return schemaTable{}, false
+}
+
+// schemaExcludedOwners are Oracle's own schemas, left out of the browser.
+var schemaExcludedOwners = []string{
+	"ANONYMOUS", "APPQOSSYS", "AUDSYS", "CTXSYS", "DBSFWUSER", "DBSNMP", "DVSYS", "GGSYS",
+	"GSMADMIN_INTERNAL", "LBACSYS", "MDSYS", "OJVMSYS", "OLAPSYS", "ORACLE_OCM", "ORDDATA",
+	"ORDSYS", "OUTLN", "PUBLIC", "REMOTE_SCHEDULER_AGENT", "SYS", "SYSTEM", "WMSYS", "XDB",
+}
+
+// schemaMaxTables caps how many tables one browser response renders.
+const schemaMaxTables = 200
+
+type schemaCache struct {
+	mu      sync.Mutex
+	schemas map[string]*tenantSchema
+}
+
+var schemas = schemaCache{schemas: map[string]*tenantSchema{}}
+
+// schemaCachePath is where the schema of tenant is cached. Only configured
+// tenants have one, so a tenant from a request can't point elsewhere.
+func schemaCachePath(tenant string) (string, error) {
+	if _, ok := config.tenant(tenant); !ok {
+		return "", fmt.Errorf("unknown tenant %q", tenant)
+	}
+	return filepath.Join(config.CacheDir, "schema", tenant+".json"), nil
+}
+
+// get returns the cached schema for tenant, loading it from disk on first
+// use. It returns nil when the tenant has never been refreshed.
+func (sc *schemaCache) get(tenant string) (*tenantSchema, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if s, ok := sc.schemas[tenant]; ok {
+		return s, nil
+	}
+
+	path, err := schemaCachePath(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var s tenantSchema
+	if err = json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("reading schema cache for %s: %w", tenant, err)
+	}
+	sc.schemas[tenant] = &s
+
+	return &s, nil
+}
+
+func (sc *schemaCache) put(s *tenantSchema) error {
+	path, err := schemaCachePath(s.Tenant)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	sc.schemas[s.Tenant] = s
+	sc.mu.Unlock()
+
+	return nil
+}
+
+// fetchSchema reads ALL_TABLES, ALL_VIEWS and ALL_TAB_COLUMNS for the tenant
+// through MP0170. The three queries run concurrently and are audited like
+// any other.
+func fetchSchema(r *http.Request, data queryRequest) (*tenantSchema, error) {
+	owners := "'" + strings.Join(schemaExcludedOwners, "', '") + "'"
+	queries := []string{
+		"SELECT OWNER, TABLE_NAME FROM ALL_TABLES WHERE OWNER NOT IN (" + owners + ")",
+		"SELECT OWNER, VIEW_NAME FROM ALL_VIEWS WHERE OWNER NOT IN (" + owners + ")",
+		"SELECT OWNER, TABLE_NAME, COLUMN_NAME, DATA_TYPE, DATA_LENGTH, DATA_PRECISION, DATA_SCALE, NULLABLE " +
+			"FROM ALL_TAB_COLUMNS WHERE OWNER NOT IN (" + owners + ") ORDER BY OWNER, TABLE_NAME, COLUMN_ID",
+	}
+
+	results := make([]*resultSet, len(queries))
+	errs := make([]error, len(queries))
+
+	var wg sync.WaitGroup
+	for i, query := range queries {
+		wg.Add(1)
+		go func(i int, query string) {
+			defer wg.Done()
+
+			q := data
+			q.Query = query
+			q.Sample = false
+			q.Unlimited = true
+			results[i], errs[i] = runResultSet(r.Context(), q, nil)
+
+			entry := newHistoryEntry(historyRun, q, errs[i])
+			if results[i] != nil {
+				entry.Rows = len(results[i].Rows)
+			}
+			auditExecution(r, entry, "schema", nil)
+		}(i, query)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	s := &tenantSchema{Tenant: data.Tenant, RefreshedAt: time.Now()}
+	byName := map[string]int{}
+
+	addTables := func(rs *resultSet, view bool) {
+		for _, row := range rs.Rows {
+			t := schemaTable{Owner: row[0], Name: row[1], View: view}
+			byName[t.QualifiedName()] = len(s.Tables)
+			s.Tables = append(s.Tables, t)
+		}
+	}
+	addTables(results[0], false)
+	addTables(results[1], true)
+
+	for _, row := range results[2].Rows {
+		i, ok := byName[row[0]+"."+row[1]]
+		if !ok {
+			continue
+		}
+		s.Tables[i].Columns = append(s.Tables[i].Columns, schemaColumn{
+			Name:      row[2],
+			Type:      row[3],
+			Length:    row[4],
+			Precision: row[5],
+			Scale:     row[6],
+			Nullable:  row[7] == "Y",
+		})
+	}
+
+	slices.SortFunc(s.Tables, func(a, b schemaTable) int { return strings.Compare(a.QualifiedName(), b.QualifiedName()) })
+
+	return s, nil
+}
+
+type schemaView struct {
+	Tenant      string
+	Filter      string
+	RefreshedAt time.Time
+	Cached      bool
+	Tables      []schemaTable
+	Matched     int
+}
+
+// filterSchema returns the tables whose name contains filter. A table that
+// only matches on column names is returned with just those columns.
+func filterSchema(s *tenantSchema, filter string) ([]schemaTable, int) {
+	filter = strings.ToUpper(strings.TrimSpace(filter))
+
+	var tables []schemaTable
+	matched := 0
+	for _, t := range s.Tables {
+		if filter != "" && !strings.Contains(t.Name, filter) {
+			var cols []schemaColumn
+			for _, c := range t.Columns {
+				if strings.Contains(c.Name, filter) {
+					cols = append(cols, c)
+				}
+			}
+			if len(cols) == 0 {
+				continue
+			}
+			t.Columns = cols
+		}
+
+		matched++
+		if len(tables) < schemaMaxTables {
+			tables = append(tables, t)
+		}
+	}
+
+	return tables, matched
+}
+
+func schemaBrowser(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	tenant := r.Form.Get("tenant")
+	if _, ok := config.tenant(tenant); !ok {
+		errorResponse(w, fmt.Sprintf("unknown tenant %q", tenant), 400)
+		return
+	}
+
+	s, err := schemas.get(tenant)
+	if err != nil {
+		errorResponse(w, err.Error(), 500)
+		return
+	}
+
+	renderSchema(w, r, tenant, s)
+}
+
+func schemaRefresh(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	var data queryRequest
+	if err := validateQueryRequest(r, &data); err != nil {
+		errorResponse(w, err.Error(), 400)
+		return
+	}
+
+	start := time.Now()
+	s, err := fetchSchema(r, data)
+	if err != nil {
+		errorResponse(w, err.Error(), limitedCode(w, err, 500))
+		return
+	}
+	fmt.Printf("Schema refresh time: %dms (%d tables)\n", time.Since(start).Milliseconds(), len(s.Tables))
+
+	if err = schemas.put(s); err != nil {
+		fmt.Printf("[ERROR]: Schema cache write error: %v\n", err)
+	}
+
+	renderSchema(w, r, data.Tenant, s)
+}
+
+func renderSchema(w http.ResponseWriter, r *http.Request, tenant string, s *tenantSchema) {
+	view := schemaView{Tenant: tenant, Filter: r.Form.Get("filter")}
+	if s != nil {
+		view.Cached = true
+		view.RefreshedAt = s.RefreshedAt
+		view.Tables, view.Matched = filterSchema(s, view.Filter)
+	}
+
+	tmpl, err := template.ParseFiles("views/schema_browser.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := "schema_browser.html"
+	if r.Header.Get("HX-Target") == "schema-tree" {
+		name = "schema_tree"
+	}
+
+	if err = tmpl.ExecuteTemplate(w, name, view); err != nil {
+		fmt.Printf("[ERROR]: Schema template execution error: %v\n", err)
+	}
+}
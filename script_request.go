@@ -0,0 +1,156 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxScriptParallel caps how many statements of a script run against EAM at
+// the same time.
+const maxScriptParallel = 4
+
+const runEventStatement = "statement"
+
+type statementResult struct {
+	Number   int
+	Query    string
+	Result   *resultSet
+	Err      error
+	Duration time.Duration
+}
+
+func (sr statementResult) Status() string {
+	var fault *eamFault
+	switch {
+	case sr.Err == nil:
+		return "OK"
+	case errors.As(sr.Err, &fault):
+		return "FAULT"
+	default:
+		return "ERROR"
+	}
+}
+
+func (sr statementResult) RowCount() int {
+	if sr.Result == nil {
+		return 0
+	}
+	return len(sr.Result.Rows)
+}
+
+func (sr statementResult) Millis() int64 {
+	return sr.Duration.Milliseconds()
+}
+
+// runScript executes each statement against EAM with at most data.Parallel
+// requests in flight, so a Parallel of 1 runs the script sequentially. A
+// failing statement does not stop the others.
+func runScript(ctx context.Context, data queryRequest, statements []string, run *runTracker) []statementResult {
+	results := make([]statementResult, len(statements))
+	sem := make(chan struct{}, max(data.Parallel, 1))
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		finished int
+	)
+
+	for i, stmt := range statements {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, stmt string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			q := data
+			q.Query = stmt
+
+			start := time.Now()
+			rs, err := runResultSet(ctx, q, run)
+			results[i] = statementResult{Number: i + 1, Query: stmt, Result: rs, Err: err, Duration: time.Since(start)}
+
+			entry := newHistoryEntry(historyScript, q, err)
+			entry.Rows = results[i].RowCount()
+			entry.DurationMs = results[i].Millis()
+			history.record(entry)
+
+			mu.Lock()
+			finished++
+			msg := fmt.Sprintf("statement %d of %d finished (%d done)", i+1, len(statements), finished)
+			mu.Unlock()
+			run.publish(runEvent{Type: runEventStatement, Message: msg})
+		}(i, stmt)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func processScript(w http.ResponseWriter, r *http.Request, data queryRequest, statements []string, run *runTracker) {
+	start := time.Now()
+	results := runScript(r.Context(), data, statements, run)
+	fmt.Printf("Script time: %dms (%d statements)\n", time.Since(start).Milliseconds(), len(statements))
+
+	format := cmp.Or(r.Header.Get("X-Process-Type"), "html")
+	for _, res := range results {
+		q := data
+		q.Query = res.Query
+		entry := newHistoryEntry(historyScript, q, res.Err)
+		entry.Rows = res.RowCount()
+		auditExecution(r, entry, format, map[string]string{
+			"statement": fmt.Sprintf("%d of %d", res.Number, len(results)),
+			"parallel":  strconv.Itoa(data.Parallel),
+			"sample":    strconv.FormatBool(data.Sample),
+		})
+	}
+
+	switch r.Header.Get("X-Process-Type") {
+	case "csv", "json":
+		err := errors.New("CSV and JSON export support a single statement, use XLSX to export a script")
+		run.failed(err)
+		errorResponse(w, err.Error(), 400)
+		return
+	case "xlsx":
+		sheets := make([]xlsxSheet, len(results))
+		for i, res := range results {
+			sheets[i] = xlsxSheet{Name: fmt.Sprintf("Statement %d", res.Number), Result: res.Result, Err: res.Err}
+		}
+
+		w.Header().Set("Content-Type", xlsxContentType)
+		w.Header().Set("Content-Disposition", "attachment; filename=data.xlsx")
+		if err := writeXlsx(w, sheets); err != nil {
+			fmt.Printf("[ERROR]: Script xlsx export error: %v\n", err)
+			run.failed(err)
+			return
+		}
+	default:
+		prefs := displayPrefsFrom(r)
+		tmpl, err := template.New("script_results.html").
+			Funcs(template.FuncMap{
+				"cells":   prefs.cells,
+				"numeric": func(rs *resultSet, i int) bool { return rs.meta(i).Numeric() },
+			}).
+			ParseFiles("views/script_results.html")
+		if err != nil {
+			run.failed(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err = tmpl.Execute(w, results); err != nil {
+			fmt.Printf("[ERROR]: Script results template execution error: %v\n", err)
+			run.failed(err)
+			return
+		}
+	}
+
+	run.finished(time.Since(start), 0)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The server key encrypts secrets the server has to keep, such as the EAM
+// credentials behind API tokens. It is created in the data directory the
+// first time it is needed, readable only by the server's user.
+var (
+	serverKeyOnce sync.Once
+	serverKey     []byte
+	serverKeyErr  error
+)
+
+func serverKeyPath() string {
+	return filepath.Join(config.DataDir, "server.key")
+}
+
+func loadServerKey() ([]byte, error) {
+	serverKeyOnce.Do(func() {
+		path := serverKeyPath()
+		key, err := os.ReadFile(path)
+		switch {
+		case err == nil && len(key) != 32:
+			err = fmt.Errorf("%s is not a 32 byte key", path)
+		case errors.Is(err, fs.ErrNotExist):
+			key = make([]byte, 32)
+			rand.Read(key)
+			if err = os.MkdirAll(filepath.Dir(path), 0o700); err == nil {
+				err = os.WriteFile(path, key, 0o600)
+			}
+		}
+		serverKey, serverKeyErr = key, err
+	})
+	return serverKey, serverKeyErr
+}
+
+// sealSecret encrypts plaintext with the server key.
+func sealSecret(plaintext string) (string, error) {
+	gcm, err := serverGcm()
+	if err != nil {
+		return "", err
+	}
+	return sealWith(gcm, plaintext), nil
+}
+
+// openSecret decrypts a value from sealSecret.
+func openSecret(sealed string) (string, error) {
+	gcm, err := serverGcm()
+	if err != nil {
+		return "", err
+	}
+	return openWith(gcm, sealed)
+}
+
+// sealWith encrypts plaintext with AES-GCM. The result is the nonce followed by
+// the ciphertext, base64 encoded.
+func sealWith(gcm cipher.AEAD, plaintext string) string {
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil))
+}
+
+func openWith(gcm cipher.AEAD, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", errors.New("malformed secret")
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("secret does not decrypt with the key")
+	}
+	return string(plaintext), nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func serverGcm() (cipher.AEAD, error) {
+	key, err := loadServerKey()
+	if err != nil {
+		return nil, err
+	}
+	return newGcm(key)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// snapshot is a saved copy of a query's output. The query, tenant and sample
+// setting are kept so the same query can be re-run later to diff against it.
+type snapshot struct {
+	Id      string     `json:"id"`
+	Name    string     `json:"name"`
+	Tenant  string     `json:"tenant"`
+	Sample  bool       `json:"sample"`
+	Query   string     `json:"query"`
+	TakenAt time.Time  `json:"takenAt"`
+	Rows    int        `json:"rows"`
+	Result  *resultSet `json:"result,omitempty"`
+}
+
+var snapshotIdPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}-[0-9a-f]{8}$`)
+
+func newSnapshotId(t time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return t.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+func snapshotPath(id string) (string, error) {
+	if !snapshotIdPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid snapshot id %q", id)
+	}
+	return filepath.Join(config.Snapshots.Dir, id+".json"), nil
+}
+
+// snapshotMetaPath is where a snapshot is kept without its result, so that
+// listing snapshots doesn't read every result.
+func snapshotMetaPath(id string) string {
+	return filepath.Join(config.Snapshots.Dir, id+".meta.json")
+}
+
+func saveSnapshot(s *snapshot) error {
+	path, err := snapshotPath(s.Id)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(config.Snapshots.Dir, 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+
+	return saveSnapshotMeta(*s)
+}
+
+func saveSnapshotMeta(s snapshot) error {
+	s.Result = nil
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(snapshotMetaPath(s.Id), data, 0o644)
+}
+
+// loadSnapshotMeta reads a snapshot without its result. Snapshots saved
+// before the metadata was kept apart get their metadata file written here.
+func loadSnapshotMeta(id string) (snapshot, error) {
+	data, err := os.ReadFile(snapshotMetaPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		s, err := loadSnapshot(id)
+		if err != nil {
+			return snapshot{}, err
+		}
+		if err = saveSnapshotMeta(*s); err != nil {
+			fmt.Printf("[ERROR]: Snapshot metadata error: %v\n", err)
+		}
+		s.Result = nil
+		return *s, nil
+	} else if err != nil {
+		return snapshot{}, err
+	}
+
+	var s snapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		return snapshot{}, fmt.Errorf("reading snapshot %s: %w", id, err)
+	}
+	return s, nil
+}
+
+func loadSnapshot(id string) (*snapshot, error) {
+	path, err := snapshotPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s snapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("reading snapshot %s: %w", id, err)
+	}
+
+	return &s, nil
+}
+
+func deleteSnapshot(id string) error {
+	path, err := snapshotPath(id)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(snapshotMetaPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// listSnapshots returns every snapshot without its result, newest first.
+func listSnapshots() ([]snapshot, error) {
+	entries, err := os.ReadDir(config.Snapshots.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snapshots []snapshot
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !snapshotIdPattern.MatchString(id) {
+			continue
+		}
+
+		s, err := loadSnapshotMeta(id)
+		if err != nil {
+			fmt.Printf("[ERROR]: Snapshot listing error: %v\n", err)
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	slices.SortFunc(snapshots, func(a, b snapshot) int { return b.TakenAt.Compare(a.TakenAt) })
+
+	return snapshots, nil
+}
+
+// pruneSnapshots applies the retention settings: only the newest Keep
+// snapshots of each name are kept, and none older than MaxAgeDays.
+func pruneSnapshots() error {
+	snapshots, err := listSnapshots()
+	if err != nil {
+		return err
+	}
+
+	keep := config.Snapshots.Keep
+	cutoff := time.Time{}
+	if config.Snapshots.MaxAgeDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -config.Snapshots.MaxAgeDays)
+	}
+
+	perName := map[string]int{}
+	for _, s := range snapshots {
+		perName[s.Name]++
+		if (keep > 0 && perName[s.Name] > keep) || s.TakenAt.Before(cutoff) {
+			if err := deleteSnapshot(s.Id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func processSnapshot(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	run := startRun(r.Form.Get("run-id"))
+
+	var data queryRequest
+	if err := validateQueryRequest(r, &data); err != nil {
+		run.failed(err)
+		errorResponse(w, err.Error(), 400)
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("snapshot-name"))
+	statements := splitStatements(data.Query)
+	if name == "" || len(statements) != 1 {
+		err := errors.New("a snapshot needs a name and exactly one statement")
+		run.failed(err)
+		errorResponse(w, err.Error(), 400)
+		return
+	}
+	data.Query = statements[0]
+
+	if !guardQuery(w, r, data, []string{data.Tenant}) {
+		run.finished(0, 0)
+		return
+	}
+
+	start := time.Now()
+	rs, err := runResultSet(r.Context(), data, run)
+
+	entry := newHistoryEntry(historySnapshot, data, err)
+	entry.Rows = run.rowCount()
+	entry.DurationMs = time.Since(start).Milliseconds()
+	history.record(entry)
+	auditExecution(r, entry, "snapshot", map[string]string{"snapshot": name, "sample": strconv.FormatBool(data.Sample)})
+
+	if err != nil {
+		run.failed(err)
+		errorResponse(w, err.Error(), limitedCode(w, err, 500))
+		return
+	}
+
+	s := &snapshot{
+		Id:      newSnapshotId(start),
+		Name:    name,
+		Tenant:  data.Tenant,
+		Sample:  data.Sample,
+		Query:   data.Query,
+		TakenAt: start,
+		Rows:    len(rs.Rows),
+		Result:  rs,
+	}
+	if err = saveSnapshot(s); err != nil {
+		run.failed(err)
+		errorResponse(w, err.Error(), 500)
+		return
+	}
+
+	if err = pruneSnapshots(); err != nil {
+		fmt.Printf("[ERROR]: Snapshot retention error: %v\n", err)
+	}
+
+	run.finished(time.Since(start), 0)
+	snapshotList(w, r)
+}
+
+// snapshotAccess returns why the user of r may not see the result of s, if
+// they may not: only those who may run its query on its tenant may.
+func snapshotAccess(r *http.Request, s snapshot) error {
+	return checkQueryAccess(requestUser(r), s.Query, []string{s.Tenant})
+}
+
+func snapshotList(w http.ResponseWriter, r *http.Request) {
+	all, err := listSnapshots()
+	if err != nil {
+		errorResponse(w, err.Error(), 500)
+		return
+	}
+
+	var snapshots []snapshot
+	for _, s := range all {
+		if snapshotAccess(r, s) == nil {
+			snapshots = append(snapshots, s)
+		}
+	}
+
+	tmpl, err := template.ParseFiles("views/snapshot_list.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tmpl.Execute(w, snapshots); err != nil {
+		fmt.Printf("[ERROR]: Snapshot list template execution error: %v\n", err)
+	}
+}
+
+func snapshotRemove(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	s, err := loadSnapshotMeta(id)
+	if err != nil {
+		errorResponse(w, err.Error(), 404)
+		return
+	}
+	if err = snapshotAccess(r, s); err != nil {
+		errorResponse(w, err.Error(), 403)
+		return
+	}
+
+	if err := deleteSnapshot(id); err != nil {
+		errorResponse(w, err.Error(), 400)
+		return
+	}
+	snapshotList(w, r)
+}
+
+// snapshotDiff diffs a snapshot against another snapshot when "against" is
+// set, or otherwise against a fresh run of the snapshot's query.
+func snapshotDiff(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	run := startRun(r.Form.Get("run-id"))
+
+	fail := func(err error, code int) {
+		run.failed(err)
+		errorResponse(w, err.Error(), code)
+	}
+
+	base, err := loadSnapshot(chi.URLParam(r, "id"))
+	if err != nil {
+		fail(err, 404)
+		return
+	}
+	if err = snapshotAccess(r, *base); err != nil {
+		fail(err, 403)
+		return
+	}
+
+	keys := parseKeyColumns(r.Form.Get("key"))
+	if len(keys) == 0 {
+		fail(errors.New("a key column is required to align rows"), 400)
+		return
+	}
+
+	start := time.Now()
+	baseLabel := fmt.Sprintf("%s (%s)", base.Name, base.TakenAt.Local().Format(time.DateTime))
+
+	var (
+		other      *resultSet
+		otherLabel string
+	)
+	if againstId := r.Form.Get("against"); againstId != "" {
+		against, err := loadSnapshot(againstId)
+		if err != nil {
+			fail(err, 404)
+			return
+		}
+		if err = snapshotAccess(r, *against); err != nil {
+			fail(err, 403)
+			return
+		}
+		other = against.Result
+		otherLabel = fmt.Sprintf("%s (%s)", against.Name, against.TakenAt.Local().Format(time.DateTime))
+	} else {
+		creds, err := sessionCredentials(r)
+		if err != nil {
+			fail(err, 401)
+			return
+		}
+
+		data := queryRequest{
+			Username: creds.Username,
+			Password: creds.Password,
+			Tenant:   base.Tenant,
+			Sample:   base.Sample,
+			Query:    base.Query,
+		}
+
+		// the re-run keeps the snapshot's sample setting to be comparable
+		if !guardRerun(w, r, data, []string{data.Tenant}) {
+			run.finished(0, 0)
+			return
+		}
+
+		other, err = runResultSet(r.Context(), data, run)
+		entry := newHistoryEntry(historySnapshot, data, err)
+		entry.Rows = run.rowCount()
+		entry.DurationMs = time.Since(start).Milliseconds()
+		history.record(entry)
+		auditExecution(r, entry, "diff", map[string]string{"snapshot": base.Name, "snapshotId": base.Id})
+		if err != nil {
+			fail(err, limitedCode(w, err, 500))
+			return
+		}
+		otherLabel = "current " + base.Tenant
+	}
+
+	diff, err := diffResultSets(base.Result, other, keys)
+	if err != nil {
+		fail(err, 400)
+		return
+	}
+	diff.BaseLabel, diff.OtherLabel = baseLabel, otherLabel
+
+	if err = renderDiffs(w, []resultComparison{{Diff: diff}}); err != nil {
+		run.failed(err)
+		return
+	}
+	run.finished(time.Since(start), 0)
+}
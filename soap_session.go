@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// soapSessionConfig controls the reuse of EAM web service sessions. Without
+// reuse every request logs in and out again. Sessions idle for longer than
+// IdleMinutes are closed rather than risking an expiry fault, and at most
+// MaxIdle are kept per user and tenant.
+type soapSessionConfig struct {
+	Reuse       bool `json:"reuse"`
+	MaxIdle     int  `json:"maxIdle"`
+	IdleMinutes int  `json:"idleMinutes"`
+}
+
+// Session scenarios of the EAM SOAP header.
+const (
+	scenarioStart     = "start"
+	scenarioContinue  = "continue"
+	scenarioTerminate = "terminate"
+)
+
+// soapHeader is the session part of a request envelope. Requests that carry
+// a session id don't send the credentials again.
+type soapHeader struct {
+	Scenario  string
+	SessionId string
+}
+
+func (h soapHeader) xml(data queryRequest) string {
+	var b strings.Builder
+	if h.SessionId == "" {
+		fmt.Fprintf(&b, `<Security xmlns="http://schemas.xmlsoap.org/ws/2002/04/secext">
+			<UsernameToken>
+				<Username>%s@%s</Username>
+				<Password>%s</Password>
+			</UsernameToken>
+		</Security>`, html.EscapeString(data.Username), html.EscapeString(data.Tenant), html.EscapeString(data.Password))
+	} else {
+		fmt.Fprintf(&b, `<Session xmlns="http://schemas.datastream.net/headers"><SessionId>%s</SessionId></Session>`, html.EscapeString(h.SessionId))
+	}
+	fmt.Fprintf(&b, "\n\t\t<SessionScenario xmlns=\"http://schemas.datastream.net/headers\">%s</SessionScenario>", h.Scenario)
+	return b.String()
+}
+
+// soapSessionKey identifies whose sessions can be reused for a request. The
+// password is part of it, hashed, so a session is never handed to someone
+// who only knows the username.
+type soapSessionKey struct {
+	Username string
+	Tenant   string
+	secret   string
+}
+
+func soapKey(data queryRequest) soapSessionKey {
+	sum := sha256.Sum256([]byte(data.Username + "\x00" + data.Password))
+	return soapSessionKey{Username: data.Username, Tenant: data.Tenant, secret: hex.EncodeToString(sum[:])}
+}
+
+type idleSoapSession struct {
+	id   string
+	used time.Time
+}
+
+// soapSessionPool holds the sessions not in use. A request takes one out for
+// its duration, so no session is used by two requests at once.
+type soapSessionPool struct {
+	mu   sync.Mutex
+	idle map[soapSessionKey][]idleSoapSession
+}
+
+var soapSessions = newSoapSessionPool()
+
+func newSoapSessionPool() *soapSessionPool {
+	p := &soapSessionPool{idle: map[soapSessionKey][]idleSoapSession{}}
+	metrics.gauge("eam_sessions_idle", func() float64 { return float64(p.count()) })
+	return p
+}
+
+func (p *soapSessionPool) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, s := range p.idle {
+		n += len(s)
+	}
+	return n
+}
+
+// take returns the most recently used live session for key. Sessions that
+// have been idle too long are closed.
+func (p *soapSessionPool) take(key soapSessionKey) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	maxIdle := time.Duration(max(config.SoapSessions.IdleMinutes, 1)) * time.Minute
+	for sessions := p.idle[key]; len(sessions) > 0; sessions = p.idle[key] {
+		s := sessions[len(sessions)-1]
+		p.idle[key] = sessions[:len(sessions)-1]
+		if time.Since(s.used) <= maxIdle {
+			return s.id, true
+		}
+		go terminateSoapSession(key, s.id)
+	}
+	return "", false
+}
+
+// put returns a session to the pool, closing the oldest beyond MaxIdle.
+func (p *soapSessionPool) put(key soapSessionKey, id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.idle[key] = append(p.idle[key], idleSoapSession{id: id, used: time.Now()})
+	for len(p.idle[key]) > max(config.SoapSessions.MaxIdle, 1) {
+		go terminateSoapSession(key, p.idle[key][0].id)
+		p.idle[key] = p.idle[key][1:]
+	}
+}
+
+// drain removes the sessions matching match from the pool and returns them.
+func (p *soapSessionPool) drain(match func(soapSessionKey) bool) map[soapSessionKey][]idleSoapSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := map[soapSessionKey][]idleSoapSession{}
+	for key, sessions := range p.idle {
+		if match(key) {
+			out[key] = sessions
+			delete(p.idle, key)
+		}
+	}
+	return out
+}
+
+// closeUser terminates the idle sessions of a user on every tenant, as they
+// log out.
+func (p *soapSessionPool) closeUser(creds credentials) {
+	secret := soapKey(queryRequest{Username: creds.Username, Password: creds.Password}).secret
+	for key, sessions := range p.drain(func(k soapSessionKey) bool { return k.secret == secret && k.Username == creds.Username }) {
+		for _, s := range sessions {
+			go terminateSoapSession(key, s.id)
+		}
+	}
+}
+
+// closeAll terminates every idle session, waiting until ctx is done at most.
+func (p *soapSessionPool) closeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for key, sessions := range p.drain(func(soapSessionKey) bool { return true }) {
+		for _, s := range sessions {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				terminateSoapSessionCtx(ctx, key, s.id)
+			}()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func terminateSoapSession(key soapSessionKey, id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	terminateSoapSessionCtx(ctx, key, id)
+}
+
+// terminateSoapSessionCtx ends a session with a trivial query, as every
+// request needs a body.
+func terminateSoapSessionCtx(ctx context.Context, key soapSessionKey, id string) {
+	data := queryRequest{Username: key.Username, Tenant: key.Tenant, Query: "SELECT 1 FROM DUAL"}
+	resp, _, err := postSoap(ctx, data, soapHeader{Scenario: scenarioTerminate, SessionId: id})
+	if err != nil {
+		fmt.Printf("[ERROR]: EAM session terminate error: %v\n", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+var (
+	sessionIdPattern      = regexp.MustCompile(`<(?:\w+:)?SessionId>([^<]+)</(?:\w+:)?SessionId>`)
+	sessionExpiredPattern = regexp.MustCompile(`(?i)session.*(expired|invalid|not valid|timed out|does not exist)`)
+)
+
+// sessionHeaderBytes is how much of a response is searched for the session
+// id, which is in the SOAP header ahead of the data.
+const sessionHeaderBytes = 16 << 10
+
+// soapSessionBody hands the session back to the pool when the response has
+// been read, picking up the id of a new session from the header on the way.
+type soapSessionBody struct {
+	io.ReadCloser
+	key  soapSessionKey
+	id   string
+	head []byte
+}
+
+func (b *soapSessionBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.id == "" && len(b.head) < sessionHeaderBytes {
+		b.head = append(b.head, p[:n]...)
+		if m := sessionIdPattern.FindSubmatch(b.head); m != nil {
+			b.id = strings.TrimSpace(string(m[1]))
+			b.head = nil
+		}
+	}
+	return n, err
+}
+
+func (b *soapSessionBody) Close() error {
+	if b.id != "" {
+		soapSessions.put(b.key, b.id)
+	}
+	return b.ReadCloser.Close()
+}
+
+// postSoap sends one MP0170 request with the given session header and
+// records how long EAM took to answer.
+func postSoap(ctx context.Context, data queryRequest, header soapHeader) (*http.Response, time.Duration, error) {
+	body := getRequestBody(data, header)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hexagonUrl, strings.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	requestTime := time.Since(start)
+	if err == nil {
+		metrics.observe("eam_request_duration_seconds", fmt.Sprintf(`scenario="%s"`, header.Scenario), requestTime.Seconds())
+	}
+
+	return resp, requestTime, err
+}
+
+// sendQuery posts the request in a reused session when there is one, or
+// starts a session to reuse later. A session that has expired on the EAM
+// side is replaced and the request sent again.
+func sendQuery(ctx context.Context, data queryRequest) (*http.Response, time.Duration, error) {
+	if !config.SoapSessions.Reuse {
+		return postSoap(ctx, data, soapHeader{Scenario: scenarioTerminate})
+	}
+
+	key := soapKey(data)
+	header := soapHeader{Scenario: scenarioStart}
+	if id, ok := soapSessions.take(key); ok {
+		header = soapHeader{Scenario: scenarioContinue, SessionId: id}
+	}
+
+	resp, requestTime, err := postSoap(ctx, data, header)
+	if err != nil {
+		return nil, requestTime, err
+	}
+
+	if header.SessionId != "" && resp.StatusCode != http.StatusOK {
+		// faults are small, so the body can be read to check for expiry
+		fault, readErr := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if readErr == nil && sessionExpiredPattern.Match(fault) {
+			metrics.add("eam_session_renewals_total", "", 1)
+			header = soapHeader{Scenario: scenarioStart}
+			resp, requestTime, err = postSoap(ctx, data, header)
+			if err != nil {
+				return nil, requestTime, err
+			}
+		} else {
+			resp.Body = io.NopCloser(bytes.NewReader(fault))
+		}
+	}
+
+	resp.Body = &soapSessionBody{ReadCloser: resp.Body, key: key, id: header.SessionId}
+	return resp, requestTime, nil
+}
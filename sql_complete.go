@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// completion is a single suggestion in the shape the ace editor's completers
+// expect.
+type completion struct {
+	Caption string `json:"caption"`
+	Value   string `json:"value"`
+	Meta    string `json:"meta"`
+	Score   int    `json:"score"`
+}
+
+type completionKind int
+
+const (
+	completeAny completionKind = iota
+	completeTable
+	completeMember
+)
+
+// tableRef is a table referenced in a FROM or JOIN clause. Group is the
+// parenthesis group the reference was made in, which decides its scope.
+type tableRef struct {
+	Table string
+	Alias string
+	Group int
+}
+
+// completionContext describes what is being typed at the cursor.
+type completionContext struct {
+	Kind   completionKind
+	Prefix string
+	// Qualifier is the identifier before the dot for member completion.
+	Qualifier string
+	// Refs are the table references visible from the cursor.
+	Refs []tableRef
+}
+
+// clauseEnd lists the keywords that end a FROM clause's table list, and
+// keywords that can never be an alias.
+var clauseEnd = []string{
+	"WHERE", "GROUP", "ORDER", "HAVING", "UNION", "INTERSECT", "MINUS", "CONNECT", "START",
+	"JOIN", "INNER", "LEFT", "RIGHT", "FULL", "OUTER", "CROSS", "NATURAL", "ON", "USING",
+	"FETCH", "OFFSET", "FOR", "MODEL", "PIVOT", "UNPIVOT", "SELECT", "FROM", "WITH",
+}
+
+func isClauseEnd(tok sqlToken) bool {
+	return tok.Kind == sqlWord && slices.ContainsFunc(clauseEnd, tok.is)
+}
+
+// analyzeCompletion works out the completion context for the cursor at byte
+// offset pos of src. Only the statement containing the cursor is considered.
+func analyzeCompletion(src string, pos int) completionContext {
+	pos = min(max(pos, 0), len(src))
+
+	tokens := tokenizeSql(src)
+
+	// narrow down to the statement around the cursor
+	first, last := 0, len(tokens)
+	for i, tok := range tokens {
+		if tok.Text != ";" {
+			continue
+		}
+		if tok.End() <= pos {
+			first = i + 1
+		} else {
+			last = i
+			break
+		}
+	}
+	tokens = tokens[first:last]
+
+	// assign each token a parenthesis group; groups[g] is g's parent
+	groups := []int{-1}
+	tokGroup := make([]int, len(tokens))
+	stack := []int{0}
+	cursorGroups := []int{0}
+	for i, tok := range tokens {
+		switch tok.Text {
+		case "(":
+			groups = append(groups, stack[len(stack)-1])
+			stack = append(stack, len(groups)-1)
+		case ")":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+		tokGroup[i] = stack[len(stack)-1]
+		if tok.Start < pos {
+			cursorGroups = slices.Clone(stack)
+		}
+	}
+
+	ctx := completionContext{Refs: collectTableRefs(tokens, tokGroup, cursorGroups)}
+
+	// significant tokens before the cursor, ignoring a partial word at the cursor
+	var before []sqlToken
+	for _, tok := range tokens {
+		if tok.Start >= pos {
+			break
+		}
+		if tok.Kind == sqlWord && tok.End() >= pos {
+			ctx.Prefix = tok.Text[:pos-tok.Start]
+			break
+		}
+		if tok.significant() {
+			before = append(before, tok)
+		}
+	}
+
+	n := len(before)
+	switch {
+	case n >= 2 && before[n-1].Text == "." && (before[n-2].Kind == sqlWord || before[n-2].Kind == sqlQuotedIdent):
+		ctx.Kind = completeMember
+		ctx.Qualifier = strings.Trim(before[n-2].Text, `"`)
+	case n >= 1 && (before[n-1].is("FROM") || before[n-1].is("JOIN")):
+		ctx.Kind = completeTable
+	case n >= 1 && before[n-1].Text == "," && inFromList(before):
+		ctx.Kind = completeTable
+	}
+
+	return ctx
+}
+
+// inFromList reports whether the tokens end inside the table list of a FROM
+// clause at the same parenthesis depth.
+func inFromList(tokens []sqlToken) bool {
+	depth := 0
+	for i := len(tokens) - 1; i >= 0; i-- {
+		switch tok := tokens[i]; {
+		case tok.Text == ")":
+			depth++
+		case tok.Text == "(":
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case depth == 0 && tok.is("FROM"):
+			return true
+		case depth == 0 && isClauseEnd(tok):
+			return false
+		}
+	}
+	return false
+}
+
+// collectTableRefs finds the tables named in FROM and JOIN clauses whose
+// group is the cursor's group or one of its ancestors, so correlated
+// subqueries see the outer query's aliases but not the other way round.
+func collectTableRefs(tokens []sqlToken, tokGroup []int, cursorGroups []int) []tableRef {
+	var sig []int
+	for i, tok := range tokens {
+		if tok.significant() {
+			sig = append(sig, i)
+		}
+	}
+
+	var refs []tableRef
+	for s := 0; s < len(sig); s++ {
+		tok := tokens[sig[s]]
+		if !tok.is("FROM") && !tok.is("JOIN") {
+			continue
+		}
+
+		group := tokGroup[sig[s]]
+		for s+1 < len(sig) {
+			s++
+			next := tokens[sig[s]]
+
+			// skip over a subquery; its alias has no known table
+			if next.Text == "(" {
+				depth := 1
+				for s+1 < len(sig) && depth > 0 {
+					s++
+					switch tokens[sig[s]].Text {
+					case "(":
+						depth++
+					case ")":
+						depth--
+					}
+				}
+			} else if next.Kind == sqlWord || next.Kind == sqlQuotedIdent {
+				name := strings.Trim(next.Text, `"`)
+				if s+2 < len(sig) && tokens[sig[s+1]].Text == "." {
+					name += "." + strings.Trim(tokens[sig[s+2]].Text, `"`)
+					s += 2
+				}
+
+				ref := tableRef{Table: name, Group: group}
+				if s+1 < len(sig) && tokens[sig[s+1]].is("AS") {
+					s++
+				}
+				if s+1 < len(sig) {
+					if alias := tokens[sig[s+1]]; (alias.Kind == sqlWord || alias.Kind == sqlQuotedIdent) && !isClauseEnd(alias) {
+						ref.Alias = strings.Trim(alias.Text, `"`)
+						s++
+					}
+				}
+
+				if slices.Contains(cursorGroups, group) {
+					refs = append(refs, ref)
+				}
+			} else {
+				s--
+				break
+			}
+
+			// a comma continues the table list, anything else ends it
+			if s+1 < len(sig) && tokens[sig[s+1]].Text == "," && tok.is("FROM") {
+				s++
+				continue
+			}
+			break
+		}
+	}
+
+	return refs
+}
+
+// completions builds the ranked suggestions for ctx from the tenant's cached
+// schema and the saved query snippets.
+func completions(ctx completionContext, schema *tenantSchema, snippets []savedQuery, snippetSql func(savedQuery) string) []completion {
+	var out []completion
+
+	matches := func(caption string) bool {
+		return ctx.Prefix == "" || strings.HasPrefix(strings.ToUpper(caption), strings.ToUpper(ctx.Prefix))
+	}
+	add := func(caption, value, meta string, base int) {
+		if !matches(caption) {
+			return
+		}
+		out = append(out, completion{Caption: caption, Value: value, Meta: meta, Score: base + history.usageCount(caption)})
+	}
+
+	addColumns := func(t schemaTable) {
+		for _, c := range t.Columns {
+			add(c.Name, c.Name, t.Name+" "+c.TypeLabel(), 1000)
+		}
+	}
+
+	switch ctx.Kind {
+	case completeMember:
+		if schema == nil {
+			break
+		}
+
+		table := ctx.Qualifier
+		for _, ref := range ctx.Refs {
+			if strings.EqualFold(ref.Alias, ctx.Qualifier) {
+				table = ref.Table
+				break
+			}
+		}
+
+		if t, ok := schema.table(table); ok {
+			addColumns(t)
+		} else {
+			// the qualifier may be an owner, e.g. EAM.R5...
+			for _, t := range schema.Tables {
+				if strings.EqualFold(t.Owner, ctx.Qualifier) {
+					add(t.Name, t.Name, "table", 500)
+				}
+			}
+		}
+	case completeTable:
+		if schema == nil {
+			break
+		}
+
+		for _, t := range schema.Tables {
+			meta := "table"
+			if t.View {
+				meta = "view"
+			}
+			add(t.Name, t.Name, meta, 1000)
+		}
+	default:
+		if schema != nil {
+			for _, ref := range ctx.Refs {
+				if t, ok := schema.table(ref.Table); ok {
+					addColumns(t)
+				}
+			}
+		}
+
+		// only the matching snippets are read
+		for _, q := range snippets {
+			if matches(q.Name) {
+				add(q.Name, snippetSql(q), "snippet", 100)
+			}
+		}
+	}
+
+	slices.SortStableFunc(out, func(a, b completion) int { return b.Score - a.Score })
+
+	return out
+}
+
+// byteOffset converts an offset in UTF-16 code units, which is how the
+// browser counts, into a byte offset into src.
+func byteOffset(src string, units int) int {
+	for i, r := range src {
+		if units <= 0 {
+			return i
+		}
+		units -= len(utf16.Encode([]rune{r}))
+	}
+	return len(src)
+}
+
+// completeSql serves editor completions. It takes the tenant, the editor
+// contents as sql and the cursor's offset as pos.
+func completeSql(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	src := r.Form.Get("sql")
+	pos, err := strconv.Atoi(r.Form.Get("pos"))
+	if err != nil {
+		pos = len(src)
+	} else {
+		pos = byteOffset(src, pos)
+	}
+
+	schema, err := schemas.get(r.Form.Get("tenant"))
+	if err != nil {
+		fmt.Printf("[ERROR]: Completion schema error: %v\n", err)
+	}
+
+	snippets, err := queries.list()
+	if err != nil {
+		fmt.Printf("[ERROR]: Completion snippet error: %v\n", err)
+	}
+
+	snippetSql := func(q savedQuery) string {
+		sql, err := queries.readSql(q.Filename)
+		if err != nil {
+			return ""
+		}
+		return sql
+	}
+
+	ctx := analyzeCompletion(src, pos)
+	out := completions(ctx, schema, snippets, snippetSql)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(out); err != nil {
+		fmt.Printf("[ERROR]: Completion encoding error: %v\n", err)
+	}
+}
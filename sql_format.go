@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// formatOptions control the SQL formatter. KeywordCase is "upper", "lower"
+// or "preserve"; CommaStyle is "trailing" or "leading".
+type formatOptions struct {
+	KeywordCase string `json:"keywordCase"`
+	Indent      int    `json:"indent"`
+	CommaStyle  string `json:"commaStyle"`
+	OnSave      bool   `json:"onSave"`
+}
+
+// sqlKeywords are the words the formatter changes the case of. Function
+// names are left alone.
+var sqlKeywords = map[string]bool{}
+
+func init() {
+	for _, kw := range strings.Fields(`
+		ALL AND ANY AS ASC BETWEEN BY CASE CONNECT CROSS DESC DISTINCT ELSE END ESCAPE EXISTS
+		FETCH FIRST FOR FROM FULL GROUP HAVING IN INNER INTERSECT IS JOIN LEFT LIKE MINUS
+		NATURAL NEXT NOCYCLE NOT NULL NULLS OFFSET ON ONLY OR ORDER OUTER OVER PARTITION
+		PRIOR RIGHT ROW ROWS SELECT SIBLINGS START THEN TIES UNION UNIQUE USING WHEN WHERE
+		WITH LAST INTERVAL DATE TIMESTAMP`) {
+		sqlKeywords[kw] = true
+	}
+}
+
+// clauseStarts begin a new line at the query's own indentation, with their
+// contents indented one level further.
+var clauseStarts = []string{"SELECT", "FROM", "WHERE", "GROUP", "ORDER", "HAVING", "CONNECT", "START", "WITH", "FETCH", "OFFSET"}
+
+// setOperators begin a new line at the query's indentation but have no
+// contents of their own.
+var setOperators = []string{"UNION", "INTERSECT", "MINUS"}
+
+// joinStarts begin a join, which goes on its own line inside the FROM clause.
+var joinStarts = []string{"JOIN", "LEFT", "RIGHT", "FULL", "INNER", "CROSS", "NATURAL"}
+
+// keywordTails continue a multi-word keyword such as GROUP BY or LEFT OUTER
+// JOIN on the same line.
+var keywordTails = []string{"BY", "ALL", "OUTER", "JOIN", "DISTINCT", "UNIQUE", "SIBLINGS", "NOCYCLE"}
+
+type formatFrame struct {
+	// query frames are opened by the statement itself and by subqueries;
+	// other parentheses only nest expressions
+	query  bool
+	level  int
+	clause string
+	on     bool
+}
+
+type sqlFormatter struct {
+	opts    formatOptions
+	b       strings.Builder
+	frames  []formatFrame
+	prev    sqlToken
+	prev2   sqlToken
+	breakAt int
+	broken  bool
+	blank   bool
+	// tail is set after a keyword that may continue, like GROUP in GROUP
+	// BY; indent is set if the keyword's contents go on the next line
+	tail    bool
+	indent  bool
+	between bool
+	cases   int
+}
+
+// errFormatChanged is returned when formatting would change the meaning of
+// the SQL rather than only its layout.
+var errFormatChanged = errors.New("the formatter can't format this SQL without changing it, so it was left as it is")
+
+// formatSql pretty-prints Oracle flavoured SQL. It only changes whitespace and
+// keyword case, so comments, string literals and quoted identifiers come out
+// exactly as they went in. It refuses, returning errFormatChanged, when the
+// result would not tokenize the same as src.
+func formatSql(src string, opts formatOptions) (string, error) {
+	if opts.Indent <= 0 {
+		opts.Indent = 4
+	}
+
+	f := &sqlFormatter{opts: opts, frames: []formatFrame{{query: true}}}
+	tokens := tokenizeSql(src)
+
+	for i, tok := range tokens {
+		switch tok.Kind {
+		case sqlWhitespace:
+			continue
+		case sqlComment:
+			f.comment(tok)
+			continue
+		}
+
+		f.token(tok, nextSignificant(tokens, i), src)
+		f.prev2, f.prev = f.prev, tok
+	}
+
+	out := strings.TrimSpace(f.b.String()) + "\n"
+	if !sameTokens(src, out) {
+		return src, errFormatChanged
+	}
+	return out, nil
+}
+
+// sameTokens reports whether a and b are the same tokens, apart from
+// whitespace, the case of words and trailing blanks in comments.
+func sameTokens(a, b string) bool {
+	relevant := func(src string) []sqlToken {
+		var tokens []sqlToken
+		for _, tok := range tokenizeSql(src) {
+			if tok.Kind != sqlWhitespace {
+				tokens = append(tokens, tok)
+			}
+		}
+		return tokens
+	}
+
+	ta, tb := relevant(a), relevant(b)
+	return slices.EqualFunc(ta, tb, func(x, y sqlToken) bool {
+		switch {
+		case x.Kind != y.Kind:
+			return false
+		case x.Kind == sqlWord:
+			return strings.EqualFold(x.Text, y.Text)
+		case x.Kind == sqlComment:
+			return strings.TrimRight(x.Text, " \t\r\n") == strings.TrimRight(y.Text, " \t\r\n")
+		}
+		return x.Text == y.Text
+	})
+}
+
+func nextSignificant(tokens []sqlToken, i int) sqlToken {
+	for _, tok := range tokens[i+1:] {
+		if tok.significant() {
+			return tok
+		}
+	}
+	return sqlToken{}
+}
+
+func (f *sqlFormatter) query() *formatFrame {
+	for i := len(f.frames) - 1; i >= 0; i-- {
+		if f.frames[i].query {
+			return &f.frames[i]
+		}
+	}
+	return &f.frames[0]
+}
+
+// atQueryLevel reports whether we are outside any expression parentheses of
+// the current query.
+func (f *sqlFormatter) atQueryLevel() bool {
+	return f.frames[len(f.frames)-1].query && f.cases == 0
+}
+
+func (f *sqlFormatter) contentLevel() int {
+	q := f.query()
+	if q.on {
+		return q.level + 2
+	}
+	return q.level + 1
+}
+
+// lineBreak asks for the next token to start on a new line at level.
+func (f *sqlFormatter) lineBreak(level int) {
+	f.broken = true
+	f.breakAt = level
+}
+
+func (f *sqlFormatter) write(text string, space bool) {
+	switch {
+	case f.b.Len() == 0:
+	case f.broken:
+		f.b.WriteString("\n")
+		if f.blank {
+			f.b.WriteString("\n")
+		}
+		f.b.WriteString(strings.Repeat(" ", f.breakAt*f.opts.Indent))
+	case space:
+		f.b.WriteString(" ")
+	}
+
+	f.broken, f.blank = false, false
+	f.b.WriteString(text)
+}
+
+func (f *sqlFormatter) comment(tok sqlToken) {
+	text := strings.TrimRight(tok.Text, " \t\r\n")
+	f.write(text, true)
+
+	if strings.HasPrefix(text, "--") || strings.Contains(text, "\n") {
+		f.lineBreak(f.contentLevel())
+	}
+}
+
+func (f *sqlFormatter) keyword(tok sqlToken) string {
+	if tok.Kind != sqlWord || !sqlKeywords[strings.ToUpper(tok.Text)] {
+		return tok.Text
+	}
+
+	switch f.opts.KeywordCase {
+	case "lower":
+		return strings.ToLower(tok.Text)
+	case "preserve":
+		return tok.Text
+	default:
+		return strings.ToUpper(tok.Text)
+	}
+}
+
+func (f *sqlFormatter) token(tok, next sqlToken, src string) {
+	upper := strings.ToUpper(tok.Text)
+	isWord := tok.Kind == sqlWord
+	space := f.spaceBefore(tok)
+
+	// words continuing a multi-word keyword stay on the keyword's line
+	if isWord && f.tail && slices.Contains(keywordTails, upper) {
+		f.write(f.keyword(tok), true)
+		return
+	}
+	if f.tail {
+		f.tail = false
+		if q := f.query(); f.indent && f.atQueryLevel() {
+			f.lineBreak(q.level + 1)
+		}
+	}
+
+	switch {
+	case tok.Text == ";" || (tok.Text == "/" && aloneOnLine(src, tok)):
+		if tok.Text == "/" {
+			// a SQL*Plus terminator only counts alone on its line
+			f.lineBreak(0)
+		}
+		f.write(tok.Text, false)
+		f.frames = []formatFrame{{query: true}}
+		f.lineBreak(0)
+		f.blank = true
+		return
+	case tok.Text == "(":
+		f.write("(", space)
+		if next.is("SELECT") || next.is("WITH") {
+			f.frames = append(f.frames, formatFrame{query: true, level: f.contentLevel() + 1})
+			f.lineBreak(f.contentLevel())
+		} else {
+			f.frames = append(f.frames, formatFrame{})
+		}
+		return
+	case tok.Text == ")":
+		if len(f.frames) > 1 {
+			closing := f.frames[len(f.frames)-1]
+			f.frames = f.frames[:len(f.frames)-1]
+			if closing.query {
+				f.lineBreak(closing.level - 1)
+			}
+		}
+		f.write(")", false)
+		return
+	case tok.Text == "," && f.atQueryLevel():
+		if f.opts.CommaStyle == "leading" {
+			f.lineBreak(f.contentLevel())
+			f.write(",", false)
+		} else {
+			f.write(",", false)
+			f.lineBreak(f.contentLevel())
+		}
+		return
+	}
+
+	if isWord && f.atQueryLevel() {
+		q := f.query()
+
+		switch {
+		case slices.Contains(clauseStarts, upper) && !(upper == "WITH" && f.prev.is("START")):
+			q.clause, q.on = upper, false
+			f.lineBreak(q.level)
+			f.write(f.keyword(tok), true)
+			f.tail, f.indent = true, true
+			return
+		case slices.Contains(setOperators, upper):
+			q.clause, q.on = upper, false
+			f.lineBreak(q.level)
+			f.write(f.keyword(tok), true)
+			f.tail, f.indent = true, false
+			return
+		case slices.Contains(joinStarts, upper) && !slices.Contains(joinStarts, strings.ToUpper(f.prev.Text)) && !f.prev.is("OUTER"):
+			q.on = false
+			f.lineBreak(q.level + 1)
+			f.write(f.keyword(tok), true)
+			f.tail, f.indent = true, false
+			return
+		case upper == "ON" && q.clause == "FROM":
+			q.on = true
+		case upper == "BETWEEN":
+			f.between = true
+		case (upper == "AND" || upper == "OR") && f.between:
+			f.between = false
+		case upper == "AND" || upper == "OR":
+			f.lineBreak(f.contentLevel())
+		}
+	}
+
+	switch upper {
+	case "CASE":
+		if isWord {
+			f.cases++
+		}
+	case "END":
+		if isWord && f.cases > 0 {
+			f.cases--
+		}
+	}
+
+	f.write(f.keyword(tok), space)
+}
+
+// spaceBefore decides whether tok is separated from the previous token.
+func (f *sqlFormatter) spaceBefore(tok sqlToken) bool {
+	prev := f.prev
+
+	switch {
+	case prev.Text == "":
+		return false
+	case strings.HasSuffix(prev.Text, "-") && strings.HasPrefix(tok.Text, "-"),
+		strings.HasSuffix(prev.Text, "/") && strings.HasPrefix(tok.Text, "*"):
+		// joined up they would start a comment
+		return true
+	case tok.Text == "," || tok.Text == ")" || tok.Text == "." || tok.Text == ";":
+		return false
+	case prev.Text == "(" || prev.Text == "." || prev.Text == ":":
+		return false
+	case tok.Text == "(" && (prev.Kind == sqlQuotedIdent || (prev.Kind == sqlWord && !sqlKeywords[strings.ToUpper(prev.Text)])):
+		// function call
+		return false
+	case (prev.Text == "-" || prev.Text == "+") && f.unary():
+		return false
+	}
+
+	return true
+}
+
+// unary reports whether the previous token, a sign, is a unary operator.
+func (f *sqlFormatter) unary() bool {
+	p := f.prev2
+	switch {
+	case p.Text == "":
+		return true
+	case p.Kind == sqlPunct && p.Text != ")":
+		return true
+	case p.Kind == sqlWord && sqlKeywords[strings.ToUpper(p.Text)]:
+		return true
+	}
+	return false
+}
+
+// parseFormatOptions reads the formatter options from a request, falling
+// back to the configured defaults.
+func parseFormatOptions(r *http.Request) formatOptions {
+	opts := config.Format
+
+	if v := r.Form.Get("keyword-case"); v != "" {
+		opts.KeywordCase = v
+	}
+	if v, err := strconv.Atoi(r.Form.Get("indent")); err == nil && v > 0 && v <= 8 {
+		opts.Indent = v
+	}
+	if v := r.Form.Get("comma-style"); v != "" {
+		opts.CommaStyle = v
+	}
+
+	return opts
+}
+
+func formatQuery(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	sql, err := formatSql(r.Form.Get("sql"), parseFormatOptions(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := fmt.Fprint(w, sql); err != nil {
+		fmt.Printf("[ERROR]: Format response error: %v\n", err)
+	}
+}
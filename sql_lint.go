@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// lintWarning is a likely mistake found in a query. Warnings never stop a
+// query from running.
+type lintWarning struct {
+	Rule    string
+	Message string
+	Line    int
+}
+
+const (
+	lintCartesianJoin = "cartesian-join"
+	lintSelectStar    = "select-star"
+	lintMissingOrg    = "missing-org"
+	lintDateFunction  = "date-function"
+	lintUnboundedPrd  = "unbounded-prd"
+)
+
+// lintConfig configures the lint rules. Rules switches individual rules on
+// or off; a rule missing from the map is on.
+type lintConfig struct {
+	Rules map[string]bool `json:"rules"`
+	// HugeTables are the tables SELECT * is flagged on.
+	HugeTables []string `json:"hugeTables"`
+	// OrgColumns maps a table to the organization column it should be
+	// filtered on.
+	OrgColumns map[string]string `json:"orgColumns"`
+	// DateColumns are indexed date columns that should not be wrapped in a
+	// function in a predicate.
+	DateColumns []string `json:"dateColumns"`
+}
+
+func (c lintConfig) enabled(rule string) bool {
+	on, ok := c.Rules[rule]
+	return !ok || on
+}
+
+// lintScope is one query block: the statement itself, a subquery or one
+// branch of a set operation.
+type lintScope struct {
+	depth  int
+	clause string
+	from   sqlToken
+	refs   []lintRef
+	preds  [][2]string
+	star   *sqlToken
+	where  bool
+	limit  bool
+	first  sqlToken
+	expect bool
+}
+
+type lintRef struct {
+	Table string
+	Alias string
+	// Joined is set for tables added with an ANSI JOIN, which carry their
+	// own join condition.
+	Joined bool
+	Tok    sqlToken
+}
+
+func (ref lintRef) qualifier() string {
+	if ref.Alias != "" {
+		return strings.ToUpper(ref.Alias)
+	}
+	return strings.ToUpper(ref.Table)
+}
+
+type sqlLinter struct {
+	src      string
+	cfg      lintConfig
+	tenant   tenantConfig
+	sample   bool
+	warnings []lintWarning
+}
+
+// lintSql checks every statement of src against the enabled rules.
+func lintSql(src string, cfg lintConfig, tenant tenantConfig, sample bool) []lintWarning {
+	l := &sqlLinter{src: src, cfg: cfg, tenant: tenant, sample: sample}
+
+	var statement []sqlToken
+	for _, tok := range tokenizeSql(src) {
+		if !tok.significant() {
+			continue
+		}
+		if tok.Text == ";" || (tok.Text == "/" && aloneOnLine(src, tok)) {
+			l.statement(statement)
+			statement = nil
+			continue
+		}
+		statement = append(statement, tok)
+	}
+	l.statement(statement)
+
+	return l.warnings
+}
+
+func (l *sqlLinter) warn(rule string, tok sqlToken, format string, args ...any) {
+	if !l.cfg.enabled(rule) {
+		return
+	}
+
+	w := lintWarning{Rule: rule, Message: fmt.Sprintf(format, args...), Line: strings.Count(l.src[:tok.Start], "\n") + 1}
+	if !slices.Contains(l.warnings, w) {
+		l.warnings = append(l.warnings, w)
+	}
+}
+
+func (l *sqlLinter) statement(tokens []sqlToken) {
+	if len(tokens) == 0 {
+		return
+	}
+
+	var (
+		stack = []*lintScope{{first: tokens[0]}}
+		done  []*lintScope
+		// filtered holds the words used in WHERE and ON conditions
+		filtered = map[string]bool{}
+	)
+
+	for i, tok := range tokens {
+		s := stack[len(stack)-1]
+		upper := strings.ToUpper(tok.Text)
+		if tok.Kind == sqlWord && s.predicate() {
+			filtered[upper] = true
+		}
+		next := func(n int) sqlToken {
+			if i+n < len(tokens) {
+				return tokens[i+n]
+			}
+			return sqlToken{}
+		}
+
+		switch {
+		case tok.Text == "(":
+			if next(1).is("SELECT") || next(1).is("WITH") {
+				stack = append(stack, &lintScope{first: next(1)})
+			} else {
+				s.depth++
+				if i > 0 && s.predicate() {
+					l.checkDateFunction(tokens, i)
+				}
+			}
+			continue
+		case tok.Text == ")":
+			if s.depth > 0 {
+				s.depth--
+			} else if len(stack) > 1 {
+				done = append(done, s)
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		if s.depth > 0 {
+			if tok.is("ROWNUM") {
+				s.limit = true
+			}
+			if tok.Text == "=" {
+				s.addPredicate(tokens, i)
+			}
+			continue
+		}
+
+		switch {
+		case tok.Kind == sqlWord && slices.Contains(setOperators, upper):
+			done = append(done, s)
+			stack[len(stack)-1] = &lintScope{first: next(1)}
+		case tok.Kind == sqlWord && slices.Contains(clauseStarts, upper):
+			s.clause = upper
+			switch upper {
+			case "FROM":
+				s.from, s.expect = tok, true
+			case "WHERE":
+				s.where = true
+			case "FETCH":
+				s.limit = true
+			}
+		case tok.is("ROWNUM"):
+			s.limit = true
+		case tok.is("JOIN"):
+			s.expect = true
+		case tok.is("ON") && s.clause == "FROM":
+			s.clause = "ON"
+		case tok.Text == "," && s.clause == "FROM":
+			s.expect = true
+		case tok.Text == "=":
+			s.addPredicate(tokens, i)
+		case tok.Text == "*" && s.clause == "SELECT":
+			if prev := tokens[i-1]; prev.is("SELECT") || prev.is("DISTINCT") || prev.Text == "," || prev.Text == "." {
+				s.star = &tokens[i]
+			}
+		case s.expect && (tok.Kind == sqlWord || tok.Kind == sqlQuotedIdent):
+			s.expect = false
+			s.addRef(tokens, i)
+		default:
+			s.expect = false
+		}
+	}
+
+	done = append(done, stack...)
+	for _, s := range done {
+		l.checkScope(s, filtered)
+	}
+
+	l.checkUnbounded(tokens[0], done)
+}
+
+// predicate reports whether the scope is in a clause that filters rows.
+func (s *lintScope) predicate() bool {
+	return s.clause == "WHERE" || s.clause == "ON" || s.clause == "CONNECT" || s.clause == "START"
+}
+
+// addRef records the table named at tokens[i], with its owner and alias.
+func (s *lintScope) addRef(tokens []sqlToken, i int) {
+	ref := lintRef{Table: strings.Trim(tokens[i].Text, `"`), Tok: tokens[i], Joined: s.clause != "FROM" || tokens[i-1].is("JOIN")}
+	if ref.Joined && i >= 2 && tokens[i-2].is("CROSS") {
+		ref.Joined = false
+	}
+
+	if i+2 < len(tokens) && tokens[i+1].Text == "." {
+		ref.Table = strings.Trim(tokens[i+2].Text, `"`)
+		i += 2
+	}
+	if i+1 < len(tokens) && tokens[i+1].is("AS") {
+		i++
+	}
+	if i+1 < len(tokens) {
+		if alias := tokens[i+1]; (alias.Kind == sqlWord || alias.Kind == sqlQuotedIdent) && !isClauseEnd(alias) {
+			ref.Alias = strings.Trim(alias.Text, `"`)
+		}
+	}
+
+	s.refs = append(s.refs, ref)
+}
+
+// addPredicate records an equality between two columns as a pair of their
+// qualifiers, "" for an unqualified column.
+func (s *lintScope) addPredicate(tokens []sqlToken, i int) {
+	left, lok := columnQualifier(tokens, i, -1)
+	right, rok := columnQualifier(tokens, i, 1)
+	if lok && rok {
+		s.preds = append(s.preds, [2]string{left, right})
+	}
+}
+
+// columnQualifier looks at the operand on one side of the operator at
+// tokens[i] and reports its qualifier if it is a plain column reference.
+func columnQualifier(tokens []sqlToken, i, dir int) (string, bool) {
+	at := func(j int) sqlToken {
+		if j >= 0 && j < len(tokens) {
+			return tokens[j]
+		}
+		return sqlToken{}
+	}
+	isName := func(tok sqlToken) bool {
+		return (tok.Kind == sqlWord && !sqlKeywords[strings.ToUpper(tok.Text)]) || tok.Kind == sqlQuotedIdent
+	}
+
+	if dir < 0 {
+		j := i - 1
+		// an outer join marker, col(+)
+		if at(j).Text == ")" && at(j-1).Text == "+" && at(j-2).Text == "(" {
+			j -= 3
+		}
+		if !isName(at(j)) {
+			return "", false
+		}
+		if at(j-1).Text == "." && isName(at(j-2)) {
+			return strings.ToUpper(strings.Trim(at(j-2).Text, `"`)), true
+		}
+		return "", true
+	}
+
+	j := i + 1
+	if !isName(at(j)) || (at(j+1).Text == "(" && at(j+2).Text != "+") {
+		return "", false
+	}
+	if at(j+1).Text == "." && isName(at(j+2)) {
+		return strings.ToUpper(strings.Trim(at(j).Text, `"`)), true
+	}
+	return "", true
+}
+
+// checkDateFunction flags a function call at tokens[i] ("(") whose arguments
+// include an indexed date column, which stops Oracle using the index.
+func (l *sqlLinter) checkDateFunction(tokens []sqlToken, i int) {
+	fn := tokens[i-1]
+	if fn.Kind != sqlWord || sqlKeywords[strings.ToUpper(fn.Text)] {
+		return
+	}
+
+	depth := 0
+	for _, tok := range tokens[i:] {
+		switch tok.Text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		if depth == 0 {
+			return
+		}
+
+		if tok.Kind == sqlWord && slices.ContainsFunc(l.cfg.DateColumns, func(c string) bool { return strings.EqualFold(c, tok.Text) }) {
+			l.warn(lintDateFunction, fn, "%s(%s) in a predicate prevents use of the index on %s, compare the column against a range instead",
+				strings.ToUpper(fn.Text), strings.ToUpper(tok.Text), strings.ToUpper(tok.Text))
+			return
+		}
+	}
+}
+
+func (l *sqlLinter) checkScope(s *lintScope, filtered map[string]bool) {
+	if s.star != nil {
+		for _, ref := range s.refs {
+			if slices.ContainsFunc(l.cfg.HugeTables, func(t string) bool { return strings.EqualFold(t, ref.Table) }) {
+				l.warn(lintSelectStar, *s.star, "SELECT * on %s, list the columns you need", strings.ToUpper(ref.Table))
+			}
+		}
+	}
+
+	for _, ref := range s.refs {
+		for table, column := range l.cfg.OrgColumns {
+			if strings.EqualFold(table, ref.Table) && !filtered[strings.ToUpper(column)] {
+				l.warn(lintMissingOrg, ref.Tok, "%s is not filtered on %s", strings.ToUpper(ref.Table), strings.ToUpper(column))
+			}
+		}
+	}
+
+	if len(s.refs) > 1 {
+		if unjoined := s.unjoinedRefs(); len(unjoined) > 0 {
+			l.warn(lintCartesianJoin, s.from, "no join condition found for %s, this is a Cartesian join", strings.Join(unjoined, ", "))
+		}
+	}
+}
+
+// checkUnbounded flags a statement against a production tenant that has no
+// WHERE clause or row limit anywhere while sample is off.
+func (l *sqlLinter) checkUnbounded(first sqlToken, scopes []*lintScope) {
+	if !l.tenant.Production || l.sample {
+		return
+	}
+
+	tables := false
+	for _, s := range scopes {
+		if s.where || s.limit {
+			return
+		}
+		tables = tables || slices.ContainsFunc(s.refs, func(ref lintRef) bool { return !strings.EqualFold(ref.Table, "DUAL") })
+	}
+
+	if tables {
+		l.warn(lintUnboundedPrd, first, "query against production %s has no WHERE clause or row limit and sample is off", l.tenant.Name)
+	}
+}
+
+// unjoinedRefs groups the scope's tables by their join conditions and
+// returns the tables outside the first group. Conditions on unqualified
+// columns can't be attributed, so each one is assumed to join one group.
+func (s *lintScope) unjoinedRefs() []string {
+	group := make([]int, len(s.refs))
+	for i := range group {
+		group[i] = i
+	}
+	find := func(i int) int {
+		for group[i] != i {
+			i = group[i]
+		}
+		return i
+	}
+	union := func(a, b int) {
+		group[find(a)] = find(b)
+	}
+	index := func(q string) int {
+		return slices.IndexFunc(s.refs, func(ref lintRef) bool { return ref.qualifier() == q })
+	}
+
+	for i, ref := range s.refs {
+		if ref.Joined {
+			union(i, 0)
+		}
+	}
+
+	wildcards := 0
+	for _, p := range s.preds {
+		a, b := index(p[0]), index(p[1])
+		switch {
+		case a >= 0 && b >= 0:
+			union(a, b)
+		case a >= 0 || b >= 0 || (p[0] == "" && p[1] == ""):
+			wildcards++
+		}
+	}
+
+	var unjoined []string
+	seen := map[int]bool{find(0): true}
+	for i, ref := range s.refs {
+		if !seen[find(i)] {
+			seen[find(i)] = true
+			unjoined = append(unjoined, strings.ToUpper(ref.Table))
+		}
+	}
+
+	if len(unjoined) <= wildcards {
+		return nil
+	}
+	return unjoined
+}
+
+// lintQuery serves the warnings for the editor contents as an HTML fragment
+// for the area next to the Run button.
+func lintQuery(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	tenant, _ := config.tenant(r.Form.Get("tenant"))
+	warnings := lintSql(r.Form.Get("query"), config.Lint, tenant, r.Form.Get("sample") == "true")
+
+	tmpl, err := template.ParseFiles("views/lint_warnings.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tmpl.Execute(w, warnings); err != nil {
+		fmt.Printf("[ERROR]: Lint template execution error: %v\n", err)
+	}
+}
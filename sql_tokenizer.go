@@ -0,0 +1,245 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type sqlTokenKind int
+
+const (
+	sqlWhitespace sqlTokenKind = iota
+	sqlComment
+	sqlString
+	sqlQuotedIdent
+	sqlWord
+	sqlNumber
+	sqlPunct
+)
+
+type sqlToken struct {
+	Kind  sqlTokenKind
+	Text  string
+	Start int
+}
+
+func (t sqlToken) End() int {
+	return t.Start + len(t.Text)
+}
+
+// is reports whether the token is the given word, ignoring case.
+func (t sqlToken) is(word string) bool {
+	return t.Kind == sqlWord && strings.EqualFold(t.Text, word)
+}
+
+// significant reports whether the token carries meaning for the statement,
+// i.e. it is not whitespace or a comment.
+func (t sqlToken) significant() bool {
+	return t.Kind != sqlWhitespace && t.Kind != sqlComment
+}
+
+// twoCharOps are the operators that are kept as a single punct token.
+var twoCharOps = []string{"<=", ">=", "<>", "!=", "^=", "||", ":=", "=>"}
+
+// qQuoteClose maps the opening delimiter of an Oracle q'[...]' literal to its
+// closing counterpart. Any other delimiter closes with itself.
+var qQuoteClose = map[byte]byte{'[': ']', '{': '}', '(': ')', '<': '>'}
+
+// tokenizeSql splits Oracle flavoured SQL into tokens. Every byte of src
+// belongs to exactly one token, so joining the token texts gives back src.
+// Unterminated strings and comments run to the end of the input.
+func tokenizeSql(src string) []sqlToken {
+	var tokens []sqlToken
+
+	for i := 0; i < len(src); {
+		start := i
+		kind := sqlPunct
+		r, size := utf8.DecodeRuneInString(src[i:])
+
+		switch {
+		case unicode.IsSpace(r):
+			kind = sqlWhitespace
+			for i < len(src) {
+				r, size = utf8.DecodeRuneInString(src[i:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				i += size
+			}
+		case strings.HasPrefix(src[i:], "--"):
+			kind = sqlComment
+			if n := strings.IndexByte(src[i:], '\n'); n >= 0 {
+				i += n
+			} else {
+				i = len(src)
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			kind = sqlComment
+			if n := strings.Index(src[i+2:], "*/"); n >= 0 {
+				i += n + 4
+			} else {
+				i = len(src)
+			}
+		case isQQuote(src[i:]):
+			kind = sqlString
+			i = scanQQuote(src, i)
+		case r == '\'':
+			kind = sqlString
+			i = scanQuoted(src, i, '\'')
+		case r == '"':
+			kind = sqlQuotedIdent
+			i = scanQuoted(src, i, '"')
+		case unicode.IsLetter(r) || r == '_':
+			kind = sqlWord
+			for i < len(src) {
+				r, size = utf8.DecodeRuneInString(src[i:])
+				if r == '@' && i+1 < len(src) && isWordStart(src[i+1:]) {
+					// a database link, as in table@remote, is part of the name
+					i += size
+					continue
+				}
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '$' && r != '#' {
+					break
+				}
+				i += size
+			}
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9'):
+			kind = sqlNumber
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			i = scanExponent(src, i)
+		default:
+			i += size
+			for _, op := range twoCharOps {
+				if strings.HasPrefix(src[start:], op) {
+					i = start + len(op)
+					break
+				}
+			}
+		}
+
+		tokens = append(tokens, sqlToken{Kind: kind, Text: src[start:i], Start: start})
+	}
+
+	return tokens
+}
+
+func isWordStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsLetter(r) || r == '_'
+}
+
+// scanExponent returns the index just past the exponent of a number, as in
+// 1e5 or 2.5E-3, when one starts at i.
+func scanExponent(src string, i int) int {
+	if i >= len(src) || (src[i] != 'e' && src[i] != 'E') {
+		return i
+	}
+	j := i + 1
+	if j < len(src) && (src[j] == '+' || src[j] == '-') {
+		j++
+	}
+	if j >= len(src) || src[j] < '0' || src[j] > '9' {
+		return i
+	}
+	for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+		j++
+	}
+	return j
+}
+
+// scanQuoted returns the index just past a quote-delimited literal starting at
+// i, treating a doubled quote as an escaped one.
+func scanQuoted(src string, i int, quote byte) int {
+	for i++; i < len(src); i++ {
+		if src[i] != quote {
+			continue
+		}
+		if i+1 < len(src) && src[i+1] == quote {
+			i++
+			continue
+		}
+		return i + 1
+	}
+
+	return len(src)
+}
+
+func isQQuote(s string) bool {
+	if len(s) > 0 && (s[0] == 'n' || s[0] == 'N') {
+		s = s[1:]
+	}
+
+	return len(s) > 2 && (s[0] == 'q' || s[0] == 'Q') && s[1] == '\''
+}
+
+func scanQQuote(src string, i int) int {
+	i = strings.IndexByte(src[i:], '\'') + i + 1
+	if i >= len(src) {
+		return len(src)
+	}
+
+	open := src[i]
+	closing, ok := qQuoteClose[open]
+	if !ok {
+		closing = open
+	}
+
+	if n := strings.Index(src[i+1:], string([]byte{closing, '\''})); n >= 0 {
+		return i + 1 + n + 2
+	}
+
+	return len(src)
+}
+
+// splitStatements breaks a script into its statements. Statements end at a
+// semicolon or at a "/" alone on its line, as in SQL*Plus, and terminators
+// inside strings and comments are ignored. Comments before and after a
+// statement are dropped so the text can be safely wrapped in a sub-select.
+func splitStatements(script string) []string {
+	var (
+		statements []string
+		first      = -1
+		last       = -1
+	)
+
+	flush := func() {
+		if first >= 0 {
+			statements = append(statements, script[first:last])
+		}
+		first, last = -1, -1
+	}
+
+	for _, tok := range tokenizeSql(script) {
+		if !tok.significant() {
+			continue
+		}
+
+		if tok.Text == ";" || (tok.Text == "/" && aloneOnLine(script, tok)) {
+			flush()
+			continue
+		}
+
+		if first < 0 {
+			first = tok.Start
+		}
+		last = tok.End()
+	}
+	flush()
+
+	return statements
+}
+
+func aloneOnLine(src string, tok sqlToken) bool {
+	lineStart := strings.LastIndexByte(src[:tok.Start], '\n') + 1
+	lineEnd := strings.IndexByte(src[tok.End():], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(src)
+	} else {
+		lineEnd += tok.End()
+	}
+
+	return strings.TrimSpace(src[lineStart:lineEnd]) == "/"
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqliteConfig sets where SQLite exports are written and the sqlite3 command
+// line tool used to write them.
+type sqliteConfig struct {
+	Binary string `json:"binary"`
+	Dir    string `json:"dir"`
+}
+
+// sqliteTarget is a table in one of the database files of Owner, under
+// config.Sqlite.Dir, that results are loaded into. Mode is "append", the
+// default, or "replace" to drop the table first. It is the output target of
+// the SQLite download and of go-server run -format sqlite, which scheduled
+// jobs use.
+type sqliteTarget struct {
+	Db    string `json:"db"`
+	Table string `json:"table"`
+	Mode  string `json:"mode,omitempty"`
+	// Owner is the user whose databases these are, so that one user can't
+	// load into or download another's. Without one, as for scheduled runs of
+	// go-server run, the databases are directly in config.Sqlite.Dir.
+	Owner string `json:"owner,omitempty"`
+}
+
+// sqliteLoad reports what a load into a table did.
+type sqliteLoad struct {
+	Rows int
+	// Added are the columns that were missing from an existing table.
+	Added []string
+	// Retyped are the columns whose existing type differs from the result's.
+	// They keep the existing type.
+	Retyped []string
+}
+
+var sqliteNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var sqliteOwnerPattern = regexp.MustCompile(`^[A-Za-z0-9_@-][A-Za-z0-9_.@-]{0,63}$`)
+
+// sqliteBatchRows is how many rows go in one INSERT statement.
+const sqliteBatchRows = 500
+
+var errSqliteNoColumns = errors.New("the result has no columns to export")
+
+// sqliteMu serialises writes, as the tool is run once per step.
+var sqliteMu sync.Mutex
+
+func (t sqliteTarget) validate() error {
+	switch {
+	case !sqliteNamePattern.MatchString(t.Db):
+		return fmt.Errorf("invalid database name %q, use letters, digits, - and _", t.Db)
+	case !sqliteNamePattern.MatchString(t.Table):
+		return fmt.Errorf("invalid table name %q, use letters, digits, - and _", t.Table)
+	case t.Mode != "" && t.Mode != "append" && t.Mode != "replace":
+		return fmt.Errorf("unknown mode %q", t.Mode)
+	}
+	return nil
+}
+
+// sqliteOwnerDir is the directory with the databases of owner. Names that
+// aren't safe as a directory name are hashed.
+func sqliteOwnerDir(owner string) string {
+	if owner == "" {
+		return config.Sqlite.Dir
+	}
+	owner = strings.ToLower(owner)
+	if !sqliteOwnerPattern.MatchString(owner) {
+		sum := sha256.Sum256([]byte(owner))
+		owner = "u-" + hex.EncodeToString(sum[:8])
+	}
+	return filepath.Join(config.Sqlite.Dir, owner)
+}
+
+func (t sqliteTarget) path() string {
+	return filepath.Join(sqliteOwnerDir(t.Owner), t.Db+".db")
+}
+
+// sqliteDatabases lists the names of the database files owner exported so
+// far.
+func sqliteDatabases(owner string) []string {
+	paths, _ := filepath.Glob(filepath.Join(sqliteOwnerDir(owner), "*.db"))
+	names := make([]string, len(paths))
+	for i, p := range paths {
+		names[i] = strings.TrimSuffix(filepath.Base(p), ".db")
+	}
+	return names
+}
+
+// sqliteType is the column type a result column is stored as.
+func sqliteType(c columnMeta) string {
+	switch c.kind() {
+	case kindNumber:
+		if c.Scale == 0 && c.Precision > 0 && c.Precision <= 18 {
+			return "INTEGER"
+		}
+		return "REAL"
+	case kindBool:
+		return "INTEGER"
+	}
+	// dates are stored as ISO 8601 text, which SQLite's date functions read
+	return "TEXT"
+}
+
+// sqliteLiteral writes a raw value of column c as an SQL literal.
+func sqliteLiteral(c columnMeta, raw string) string {
+	if raw == "" {
+		return "NULL"
+	}
+
+	switch v := typedValue(c, raw).(type) {
+	case json.Number:
+		return v.String()
+	case time.Time:
+		if v.Hour() == 0 && v.Minute() == 0 && v.Second() == 0 {
+			return "'" + v.Format(time.DateOnly) + "'"
+		}
+		return "'" + v.Format(time.DateTime) + "'"
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	}
+
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(raw, "\x00", ""), "'", "''") + "'"
+}
+
+func sqliteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqliteColumns names the result's columns for the table, numbering repeats
+// since SQLite compares column names without case.
+func sqliteColumns(rs *resultSet) []string {
+	names := make([]string, len(rs.Columns))
+	for i, label := range rs.Columns {
+		name := label
+		for n := 2; slices.ContainsFunc(names[:i], func(s string) bool { return strings.EqualFold(s, name) }); n++ {
+			name = label + "_" + strconv.Itoa(n)
+		}
+		names[i] = name
+	}
+	return names
+}
+
+// sqlite runs the tool on db with script as its input.
+func sqlite(ctx context.Context, db string, script string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, config.Sqlite.Binary, append(args, db)...)
+	cmd.Stdin = strings.NewReader(script)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("sqlite3: %s", msg)
+		}
+		return nil, fmt.Errorf("sqlite3: %w", err)
+	}
+	return out, nil
+}
+
+// tableColumns returns the columns of the target table and their types, or
+// nothing when it does not exist yet.
+func (t sqliteTarget) tableColumns(ctx context.Context) (map[string]string, error) {
+	out, err := sqlite(ctx, t.path(), fmt.Sprintf("PRAGMA table_info(%s);\n", sqliteIdent(t.Table)), "-json")
+	if err != nil {
+		return nil, err
+	}
+
+	var info []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	if len(bytes.TrimSpace(out)) > 0 {
+		if err = json.Unmarshal(out, &info); err != nil {
+			return nil, fmt.Errorf("reading the columns of %s: %w", t.Table, err)
+		}
+	}
+
+	columns := map[string]string{}
+	for _, c := range info {
+		columns[strings.ToLower(c.Name)] = strings.ToUpper(c.Type)
+	}
+	return columns, nil
+}
+
+// write loads rs into the target table, creating the database and the table
+// as needed. Columns the table doesn't have yet are added; columns the result
+// doesn't have are left empty. The load is one transaction.
+func (t sqliteTarget) write(ctx context.Context, rs *resultSet) (sqliteLoad, error) {
+	load := sqliteLoad{Rows: len(rs.Rows)}
+	if err := t.validate(); err != nil {
+		return load, err
+	}
+	if len(rs.Columns) == 0 {
+		return load, errSqliteNoColumns
+	}
+
+	sqliteMu.Lock()
+	defer sqliteMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(t.path()), 0o755); err != nil {
+		return load, err
+	}
+
+	existing := map[string]string{}
+	if t.Mode != "replace" {
+		var err error
+		if existing, err = t.tableColumns(ctx); err != nil {
+			return load, err
+		}
+	}
+
+	names := sqliteColumns(rs)
+	table := sqliteIdent(t.Table)
+	var b strings.Builder
+	b.WriteString(".bail on\nBEGIN;\n")
+
+	if len(existing) == 0 {
+		defs := make([]string, len(names))
+		for i, name := range names {
+			defs[i] = sqliteIdent(name) + " " + sqliteType(rs.meta(i))
+		}
+		fmt.Fprintf(&b, "DROP TABLE IF EXISTS %s;\nCREATE TABLE %s (%s);\n", table, table, strings.Join(defs, ", "))
+	} else {
+		for i, name := range names {
+			typ := sqliteType(rs.meta(i))
+			have, ok := existing[strings.ToLower(name)]
+			switch {
+			case !ok:
+				fmt.Fprintf(&b, "ALTER TABLE %s ADD COLUMN %s %s;\n", table, sqliteIdent(name), typ)
+				load.Added = append(load.Added, name)
+			case have != typ:
+				load.Retyped = append(load.Retyped, name)
+			}
+		}
+	}
+
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = sqliteIdent(name)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES\n", table, strings.Join(quoted, ", "))
+
+	for start := 0; start < len(rs.Rows); start += sqliteBatchRows {
+		b.WriteString(insert)
+		for r, row := range rs.Rows[start:min(start+sqliteBatchRows, len(rs.Rows))] {
+			if r > 0 {
+				b.WriteString(",\n")
+			}
+			b.WriteString("(")
+			for i := range names {
+				if i > 0 {
+					b.WriteString(", ")
+				}
+				value := ""
+				if i < len(row) {
+					value = row[i]
+				}
+				b.WriteString(sqliteLiteral(rs.meta(i), value))
+			}
+			b.WriteString(")")
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("COMMIT;\n")
+
+	_, err := sqlite(ctx, t.path(), b.String())
+	return load, err
+}
+
+// resultSqlite loads the cached result, as currently viewed, into a table of
+// a local SQLite database and downloads the database file.
+func resultSqlite(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	r.ParseForm()
+
+	c, ok := requestResult(w, r)
+	if !ok {
+		return
+	}
+
+	target := sqliteTarget{
+		Db:    strings.TrimSpace(r.Form.Get("sqlite-db")),
+		Table: strings.TrimSpace(r.Form.Get("sqlite-table")),
+		Mode:  r.Form.Get("sqlite-mode"),
+		Owner: requestUser(r).Name,
+	}
+	if err := target.validate(); err != nil {
+		errorResponse(w, err.Error(), 400)
+		return
+	}
+
+	viewed := c.View.apply(c.Result)
+	load, err := target.write(r.Context(), viewed)
+	auditCachedExport(r, c, len(viewed.Rows), "sqlite", err)
+	if errors.Is(err, errSqliteNoColumns) {
+		errorResponse(w, err.Error(), 400)
+		return
+	} else if err != nil {
+		fmt.Printf("[ERROR]: SQLite export error: %v\n", err)
+		errorResponse(w, err.Error(), 500)
+		return
+	}
+	if len(load.Added) > 0 || len(load.Retyped) > 0 {
+		fmt.Printf("SQLite export to %s.%s added columns %v, kept the existing types of %v\n", target.Db, target.Table, load.Added, load.Retyped)
+	}
+
+	f, err := os.Open(target.path())
+	if err != nil {
+		errorResponse(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", "attachment; filename="+target.Db+".db")
+	if _, err = io.Copy(w, f); err != nil {
+		fmt.Printf("[ERROR]: SQLite download error: %v\n", err)
+	}
+}
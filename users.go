@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// role is what a user of go-server may do. Each role includes the ones
+// below it.
+type role int
+
+const (
+	roleViewer      role = iota + 1 // runs saved queries only
+	roleAnalyst                     // also runs ad-hoc SQL on non-production tenants
+	roleProdAnalyst                 // also runs ad-hoc SQL on production tenants
+	roleAdmin                       // also uses the form designer
+)
+
+var roleNames = []string{roleViewer: "viewer", roleAnalyst: "analyst", roleProdAnalyst: "prod-analyst", roleAdmin: "admin"}
+
+func parseRole(s string) (role, bool) {
+	i := slices.Index(roleNames, s)
+	if i < 1 {
+		return 0, false
+	}
+	return role(i), true
+}
+
+func (r role) String() string {
+	if r < roleViewer || r > roleAdmin {
+		return "none"
+	}
+	return roleNames[r]
+}
+
+// appUser is a user of go-server itself, not of EAM. Users signing in
+// through a proxy header have no password hash.
+type appUser struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Hash      string    `json:"hash,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (u appUser) role() role {
+	r, _ := parseRole(u.Role)
+	return r
+}
+
+type userStore struct {
+	mu sync.Mutex
+}
+
+var users = &userStore{}
+
+var errBadLogin = errors.New("unknown user or wrong password")
+
+func usersPath() string {
+	return filepath.Join(config.DataDir, "users.json")
+}
+
+func (s *userStore) read() ([]appUser, error) {
+	data, err := os.ReadFile(usersPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list []appUser
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", usersPath(), err)
+	}
+	return list, nil
+}
+
+func (s *userStore) write(list []appUser) error {
+	data, err := json.MarshalIndent(list, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(config.DataDir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(usersPath(), append(data, '\n'))
+}
+
+func (s *userStore) list() ([]appUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read()
+}
+
+func (s *userStore) get(name string) (appUser, bool, error) {
+	list, err := s.list()
+	if err != nil {
+		return appUser{}, false, err
+	}
+
+	i := slices.IndexFunc(list, func(u appUser) bool { return strings.EqualFold(u.Name, name) })
+	if i < 0 {
+		return appUser{}, false, nil
+	}
+	return list[i], true, nil
+}
+
+// update changes the named user with fn, or adds them when create is set.
+func (s *userStore) update(name string, create bool, fn func(*appUser) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(list, func(u appUser) bool { return strings.EqualFold(u.Name, name) })
+	switch {
+	case i >= 0 && create:
+		return fmt.Errorf("user %q already exists", name)
+	case i < 0 && !create:
+		return fmt.Errorf("no user %q", name)
+	case i < 0:
+		list = append(list, appUser{Name: name, CreatedAt: time.Now()})
+		i = len(list) - 1
+	}
+
+	if err = fn(&list[i]); err != nil {
+		return err
+	}
+	return s.write(list)
+}
+
+func (s *userStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(list, func(u appUser) bool { return strings.EqualFold(u.Name, name) })
+	if i < 0 {
+		return fmt.Errorf("no user %q", name)
+	}
+	return s.write(slices.Delete(list, i, i+1))
+}
+
+// dummyHash is compared against for unknown users, so a failed sign in
+// takes as long whether or not the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("go-server"), bcrypt.DefaultCost)
+
+// verify checks a user's password.
+func (s *userStore) verify(name, password string) (appUser, error) {
+	u, ok, err := s.get(name)
+	if err != nil {
+		return appUser{}, err
+	}
+
+	hash := dummyHash
+	if ok && u.Hash != "" {
+		hash = []byte(u.Hash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok || u.Hash == "" {
+		return appUser{}, errBadLogin
+	}
+	return u, nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < 8 {
+		return "", errors.New("a password needs at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+const usersUsage = `Usage of users:
+  go-server users list
+  go-server users add -role ROLE [-proxy] NAME
+  go-server users passwd NAME
+  go-server users role -role ROLE NAME
+  go-server users rm NAME
+
+Roles are viewer, analyst, prod-analyst and admin. add and passwd read the
+password from GS_PASSWORD or the first line of stdin. -proxy adds a user
+without a password, who signs in through the auth.header of a reverse
+proxy.
+`
+
+// cliUsers manages the go-server users and returns the exit code.
+func cliUsers(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usersUsage)
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("users "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usersUsage) }
+	roleName := fs.String("role", "", "")
+	proxy := fs.Bool("proxy", false, "")
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOk
+		}
+		return exitUsage
+	}
+
+	fail := func(format string, a ...any) int {
+		fmt.Fprintf(stderr, "go-server users %s: "+format+"\n", append([]any{args[0]}, a...)...)
+		return exitUsage
+	}
+
+	if args[0] == "list" {
+		list, err := users.list()
+		if err != nil {
+			return fail("%v", err)
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		for _, u := range list {
+			kind := "password"
+			if u.Hash == "" {
+				kind = "proxy"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Name, u.Role, kind, u.CreatedAt.Format(time.DateOnly))
+		}
+		tw.Flush()
+		return exitOk
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprint(stderr, usersUsage)
+		return exitUsage
+	}
+	name := strings.TrimSpace(fs.Arg(0))
+
+	readPassword := func() (string, error) { return readSecret(stdin, "GS_PASSWORD") }
+
+	var err error
+	switch args[0] {
+	case "add":
+		r, ok := parseRole(*roleName)
+		if !ok {
+			return fail("unknown role %q", *roleName)
+		}
+		hash := ""
+		if !*proxy {
+			password, perr := readPassword()
+			if perr != nil {
+				return fail("%v", perr)
+			}
+			if hash, err = hashPassword(password); err != nil {
+				return fail("%v", err)
+			}
+		}
+		err = users.update(name, true, func(u *appUser) error {
+			u.Role, u.Hash = r.String(), hash
+			return nil
+		})
+
+	case "passwd":
+		password, perr := readPassword()
+		if perr != nil {
+			return fail("%v", perr)
+		}
+		hash, herr := hashPassword(password)
+		if herr != nil {
+			return fail("%v", herr)
+		}
+		err = users.update(name, false, func(u *appUser) error {
+			u.Hash = hash
+			return nil
+		})
+
+	case "role":
+		r, ok := parseRole(*roleName)
+		if !ok {
+			return fail("unknown role %q", *roleName)
+		}
+		err = users.update(name, false, func(u *appUser) error {
+			u.Role = r.String()
+			return nil
+		})
+
+	case "rm":
+		err = users.remove(name)
+
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usersUsage)
+		return exitUsage
+	}
+
+	if err != nil {
+		return fail("%v", err)
+	}
+	return exitOk
+}
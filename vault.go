@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The vault holds service account credentials for unattended runs, so that
+// scripts refer to an entry by name instead of carrying a password. The
+// whole entry list is encrypted, with a key derived from a passphrase or
+// read from a key file. Passwords are never printed.
+
+// vaultEntry is one service account.
+type vaultEntry struct {
+	Tenant    string    `json:"tenant"`
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// vaultFile is the vault as stored. Data is the sealed JSON of the entries.
+type vaultFile struct {
+	Version int       `json:"version"`
+	Kdf     vaultKdf  `json:"kdf"`
+	Data    string    `json:"data"`
+	Updated time.Time `json:"updated"`
+}
+
+// vaultKdf says where the key comes from: "scrypt" derives it from the
+// passphrase with the given parameters, "keyfile" reads it from a file.
+type vaultKdf struct {
+	Name string `json:"name"`
+	Salt string `json:"salt,omitempty"`
+	N    int    `json:"n,omitempty"`
+	R    int    `json:"r,omitempty"`
+	P    int    `json:"p,omitempty"`
+}
+
+// vaultKey is how the key of a vault is supplied. The passphrase is only
+// taken from the environment, so it doesn't show in the process list.
+type vaultKey struct {
+	keyFile    string
+	passphrase string
+}
+
+func envVaultKey() vaultKey {
+	return vaultKey{keyFile: os.Getenv("EAM_VAULT_KEYFILE"), passphrase: os.Getenv("EAM_VAULT_PASSPHRASE")}
+}
+
+func defaultVaultPath() string {
+	if p := os.Getenv("EAM_VAULT"); p != "" {
+		return p
+	}
+	return filepath.Join(config.DataDir, "vault.json")
+}
+
+var errVaultKey = errors.New("the vault does not open with this key or passphrase")
+
+// vault is an opened vault.
+type vault struct {
+	path    string
+	kdf     vaultKdf
+	gcm     cipher.AEAD
+	entries map[string]vaultEntry
+}
+
+func (k vaultKey) gcm(kdf vaultKdf) (cipher.AEAD, error) {
+	var key []byte
+	switch kdf.Name {
+	case "keyfile":
+		if k.keyFile == "" {
+			return nil, errors.New("the vault needs its key file, set EAM_VAULT_KEYFILE or give -key-file")
+		}
+		data, err := os.ReadFile(k.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != 32 {
+			return nil, fmt.Errorf("%s is not a 32 byte key", k.keyFile)
+		}
+		key = data
+	case "scrypt":
+		if k.passphrase == "" {
+			return nil, errors.New("the vault needs its passphrase, set EAM_VAULT_PASSPHRASE")
+		}
+		salt, err := base64.StdEncoding.DecodeString(kdf.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("bad vault salt: %w", err)
+		}
+		if key, err = scrypt.Key([]byte(k.passphrase), salt, kdf.N, kdf.R, kdf.P, 32); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown vault kdf %q", kdf.Name)
+	}
+	return newGcm(key)
+}
+
+// createVault makes an empty vault at path. With a key file that doesn't
+// exist yet, a new key is written to it.
+func createVault(path string, key vaultKey) (*vault, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+
+	kdf := vaultKdf{Name: "scrypt", N: 1 << 15, R: 8, P: 1}
+	if key.keyFile != "" {
+		kdf = vaultKdf{Name: "keyfile"}
+		if _, err := os.Stat(key.keyFile); errors.Is(err, fs.ErrNotExist) {
+			b := make([]byte, 32)
+			rand.Read(b)
+			if err = os.WriteFile(key.keyFile, b, 0o600); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		salt := make([]byte, 16)
+		rand.Read(salt)
+		kdf.Salt = base64.StdEncoding.EncodeToString(salt)
+	}
+
+	gcm, err := key.gcm(kdf)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &vault{path: path, kdf: kdf, gcm: gcm, entries: map[string]vaultEntry{}}
+	return v, v.save()
+}
+
+// openVault reads and decrypts the vault at path.
+func openVault(path string, key vaultKey) (*vault, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no vault at %s, create one with go-server vault init", path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f vaultFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	gcm, err := key.gcm(f.Kdf)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openWith(gcm, f.Data)
+	if err != nil {
+		return nil, errVaultKey
+	}
+
+	v := &vault{path: path, kdf: f.Kdf, gcm: gcm}
+	if err = json.Unmarshal([]byte(plaintext), &v.entries); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if v.entries == nil {
+		v.entries = map[string]vaultEntry{}
+	}
+	return v, nil
+}
+
+func (v *vault) save() error {
+	plaintext, err := json.Marshal(v.entries)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(vaultFile{Version: 1, Kdf: v.kdf, Data: sealWith(v.gcm, string(plaintext)), Updated: time.Now()}, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(v.path), 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(v.path, append(data, '\n'))
+}
+
+func (v *vault) names() []string {
+	names := make([]string, 0, len(v.entries))
+	for name := range v.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// vaultCredentials returns the credentials and tenant of the named entry.
+func vaultCredentials(path, name string) (credentials, string, error) {
+	v, err := openVault(path, envVaultKey())
+	if err != nil {
+		return credentials{}, "", err
+	}
+
+	e, ok := v.entries[name]
+	if !ok {
+		return credentials{}, "", fmt.Errorf("no vault entry %q", name)
+	}
+	return credentials{Username: e.Username, Password: e.Password}, e.Tenant, nil
+}
+
+// readSecret takes a password from the environment variable env or the
+// first line of stdin, never from a flag.
+func readSecret(stdin io.Reader, env string) (string, error) {
+	if p := os.Getenv(env); p != "" {
+		return p, nil
+	}
+
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if line = strings.TrimRight(line, "\r\n"); line == "" {
+		return "", fmt.Errorf("no password, set %s or write it to stdin", env)
+	}
+	return line, nil
+}
+
+const vaultUsage = `Usage of vault:
+  go-server vault init [-key-file PATH]
+  go-server vault list
+  go-server vault add -tenant TENANT -username USER NAME
+  go-server vault rotate [-username USER] NAME
+  go-server vault rm NAME
+
+The vault is data/vault.json, or the file in EAM_VAULT or given by -vault.
+It is unlocked by the passphrase in EAM_VAULT_PASSPHRASE or, when created
+with -key-file, the key in that file (also EAM_VAULT_KEYFILE). init writes a
+new key file if it doesn't exist.
+
+add and rotate read the password from EAM_PASSWORD or the first line of
+stdin. Use an entry with go-server run -cred NAME.
+`
+
+// cliVault manages the credential vault and returns the exit code.
+func cliVault(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, vaultUsage)
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("vault "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, vaultUsage) }
+	path := fs.String("vault", defaultVaultPath(), "")
+	keyFile := fs.String("key-file", os.Getenv("EAM_VAULT_KEYFILE"), "")
+	tenant := fs.String("tenant", "", "")
+	username := fs.String("username", "", "")
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOk
+		}
+		return exitUsage
+	}
+
+	fail := func(format string, a ...any) int {
+		fmt.Fprintf(stderr, "go-server vault %s: "+format+"\n", append([]any{args[0]}, a...)...)
+		return exitUsage
+	}
+
+	key := vaultKey{keyFile: *keyFile, passphrase: os.Getenv("EAM_VAULT_PASSPHRASE")}
+	if args[0] == "init" {
+		if key.keyFile == "" && key.passphrase == "" {
+			return fail("set EAM_VAULT_PASSPHRASE or give -key-file")
+		}
+		if _, err := createVault(*path, key); err != nil {
+			return fail("%v", err)
+		}
+		fmt.Fprintf(stderr, "created %s\n", *path)
+		return exitOk
+	}
+
+	v, err := openVault(*path, key)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	needName := func() (string, bool) {
+		if fs.NArg() != 1 {
+			fmt.Fprint(stderr, vaultUsage)
+			return "", false
+		}
+		return fs.Arg(0), true
+	}
+
+	switch args[0] {
+	case "list":
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		for _, name := range v.names() {
+			e := v.entries[name]
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", name, e.Tenant, e.Username, e.UpdatedAt.Format(time.DateOnly))
+		}
+		tw.Flush()
+		return exitOk
+
+	case "add":
+		name, ok := needName()
+		if !ok {
+			return exitUsage
+		}
+		if _, exists := v.entries[name]; exists {
+			return fail("%q already exists, use rotate to change it", name)
+		}
+		if _, ok := config.tenant(*tenant); !ok {
+			return fail("unknown tenant %q", *tenant)
+		}
+		if *username == "" {
+			return fail("an entry needs a -username")
+		}
+		password, err := readSecret(stdin, "EAM_PASSWORD")
+		if err != nil {
+			return fail("%v", err)
+		}
+		v.entries[name] = vaultEntry{Tenant: *tenant, Username: *username, Password: password, UpdatedAt: time.Now()}
+
+	case "rotate":
+		name, ok := needName()
+		if !ok {
+			return exitUsage
+		}
+		e, exists := v.entries[name]
+		if !exists {
+			return fail("no entry %q", name)
+		}
+		password, err := readSecret(stdin, "EAM_PASSWORD")
+		if err != nil {
+			return fail("%v", err)
+		}
+		if *username != "" {
+			e.Username = *username
+		}
+		e.Password, e.UpdatedAt = password, time.Now()
+		v.entries[name] = e
+
+	case "rm":
+		name, ok := needName()
+		if !ok {
+			return exitUsage
+		}
+		if _, exists := v.entries[name]; !exists {
+			return fail("no entry %q", name)
+		}
+		delete(v.entries, name)
+
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], vaultUsage)
+		return exitUsage
+	}
+
+	if err = v.save(); err != nil {
+		return fail("%v", err)
+	}
+	return exitOk
+}
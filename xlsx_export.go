@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// xlsxSheet is one worksheet of an export. A sheet with Err set holds the
+// error message instead of a result.
+type xlsxSheet struct {
+	Name   string
+	Result *resultSet
+	Err    error
+}
+
+// xlsxNameReplacer strips the characters Excel does not allow in sheet names.
+var xlsxNameReplacer = strings.NewReplacer("[", "", "]", "", ":", "", "*", "", "?", "", "/", "", "\\", "")
+
+func writeXlsx(w io.Writer, sheets []xlsxSheet) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	used := map[string]bool{}
+	for i, sheet := range sheets {
+		name := xlsxSheetName(sheet.Name, i, used)
+
+		if i == 0 {
+			if err := f.SetSheetName("Sheet1", name); err != nil {
+				return err
+			}
+		} else if _, err := f.NewSheet(name); err != nil {
+			return err
+		}
+
+		if err := writeXlsxSheet(f, name, sheet); err != nil {
+			return err
+		}
+	}
+
+	return f.Write(w)
+}
+
+func writeXlsxSheet(f *excelize.File, name string, sheet xlsxSheet) error {
+	sw, err := f.NewStreamWriter(name)
+	if err != nil {
+		return err
+	}
+
+	dateStyle, err := f.NewStyle(&excelize.Style{NumFmt: 14})
+	if err != nil {
+		return err
+	}
+
+	rows := [][]interface{}{{"Error"}, {""}}
+	if sheet.Err != nil {
+		rows[1][0] = sheet.Err.Error()
+	} else {
+		rs := sheet.Result
+		rows = make([][]interface{}, 0, len(rs.Rows)+1)
+		rows = append(rows, xlsxRow(rs.Columns))
+		for _, row := range rs.Rows {
+			cells := make([]interface{}, len(row))
+			for i, v := range row {
+				cells[i] = xlsxValue(typedValue(rs.meta(i), v), dateStyle)
+			}
+			rows = append(rows, cells)
+		}
+	}
+
+	for i, row := range rows {
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := sw.SetRow(cell, row); err != nil {
+			return err
+		}
+	}
+
+	return sw.Flush()
+}
+
+// xlsxValue converts a typed value to what the stream writer expects. Numbers
+// with more digits than a float holds stay text, and dates without a time get
+// a date-only format.
+func xlsxValue(value any, dateStyle int) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if len(strings.Trim(string(v), "-+.0")) > 15 {
+			return string(v)
+		}
+		f, _ := v.Float64()
+		return f
+	case time.Time:
+		if v.Hour() == 0 && v.Minute() == 0 && v.Second() == 0 {
+			return excelize.Cell{StyleID: dateStyle, Value: v}
+		}
+		return v
+	case nil:
+		return ""
+	}
+	return value
+}
+
+func xlsxRow(values []string) []interface{} {
+	row := make([]interface{}, len(values))
+	for i, v := range values {
+		row[i] = v
+	}
+	return row
+}
+
+// xlsxSheetName makes name valid and unique for a workbook: at most 31
+// characters, no reserved characters, and never blank.
+func xlsxSheetName(name string, index int, used map[string]bool) string {
+	name = strings.TrimSpace(xlsxNameReplacer.Replace(name))
+	if name == "" {
+		name = fmt.Sprintf("Sheet%d", index+1)
+	}
+	// Excel counts characters, so cut runes rather than bytes
+	base := []rune(name)
+	if len(base) > 31 {
+		base = base[:31]
+	}
+
+	name = string(base)
+	for n := 2; used[strings.ToLower(name)]; n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		name = string(base[:min(len(base), 31-len(suffix))]) + suffix
+	}
+	used[strings.ToLower(name)] = true
+
+	return name
+}